@@ -0,0 +1,23 @@
+data "maas_allocation_candidates" "gpu" {
+  pool           = "gpu"
+  tags           = ["nvme"]
+  min_cpu_count  = 32
+  max_candidates = 3
+}
+
+resource "maas_instance" "gpu" {
+  count = 3
+
+  allocate_params {
+    pool          = "gpu"
+    tags          = ["nvme"]
+    min_cpu_count = 32
+  }
+
+  lifecycle {
+    precondition {
+      condition     = length(data.maas_allocation_candidates.gpu.ids) >= 3
+      error_message = "The gpu pool does not have 3 machines matching the allocation constraints."
+    }
+  }
+}
@@ -0,0 +1,14 @@
+data "maas_machines" "gpu_ready" {
+  status = ["Ready"]
+  pool   = ["gpu"]
+  zone   = ["az1"]
+  tags   = ["nvme"]
+}
+
+resource "maas_instance" "gpu" {
+  for_each = { for m in data.maas_machines.gpu_ready.machines : m.hostname => m }
+
+  allocate_params {
+    hostname = each.key
+  }
+}
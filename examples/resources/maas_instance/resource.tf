@@ -14,3 +14,140 @@ resource "maas_instance" "kvm" {
     distro_series = "focal"
   }
 }
+
+resource "maas_instance" "customer_data" {
+  allocate_params {
+    pool = "customers"
+  }
+  release_params {
+    secure_erase = true
+    comment      = "Released {{ .Hostname }} after the customer data retention period"
+  }
+}
+
+resource "maas_instance" "storage" {
+  allocate_params {
+    storage = "root:500(ssd),data:2000,data:2000"
+  }
+  storage_layout {
+    layout    = "lvm"
+    root_size = "100G"
+  }
+}
+
+resource "maas_instance" "labeled_interfaces" {
+  allocate_params {
+    interfaces = "eth_storage:space=storage;eth_pub:space=public"
+  }
+  network_interfaces {
+    label       = "eth_storage"
+    subnet_cidr = "10.20.0.0/16"
+  }
+  network_interfaces {
+    label       = "eth_pub"
+    subnet_cidr = "192.168.10.0/24"
+  }
+}
+
+resource "maas_instance" "centos" {
+  allocate_params {
+    pool = "legacy"
+  }
+  deploy_params {
+    osystem       = "centos"
+    distro_series = "centos8-stream"
+    kernel_opts   = "console=ttyS0,115200 intel_iommu=on"
+  }
+}
+
+resource "maas_instance" "database" {
+  count = 3
+  allocate_params {
+    tags = ["database"]
+  }
+  deploy_params {
+    distro_series = "noble"
+    user_data     = file("${path.module}/database-user-data.yaml")
+  }
+  redeploy_on_change = true
+}
+
+resource "maas_instance" "worker" {
+  allocate_params {
+    tags = ["worker"]
+  }
+  deploy_params {
+    distro_series = "noble"
+  }
+  on_deploy_failure   = "release_and_retry"
+  max_deploy_attempts = 2
+
+  hostname    = "worker-01"
+  description = "CI worker"
+  pool        = "ci"
+  tags        = ["worker", "ci"]
+
+  owner_data = {
+    team    = "platform"
+    service = "ci"
+  }
+}
+
+resource "maas_instance" "hypervisor" {
+  allocate_params {
+    tags       = ["hypervisor"]
+    interfaces = "eth_a:fabric=fabric-0;eth_b:fabric=fabric-0"
+  }
+  network_interfaces {
+    name = "bond0"
+    mode = "LINK_UP"
+    bond {
+      parents   = ["eth_a", "eth_b"]
+      bond_mode = "802.3ad"
+    }
+  }
+  network_interfaces {
+    subnet_cidr = "10.10.100.0/24"
+    vlan {
+      parent = "bond0"
+      vid    = 100
+    }
+  }
+  network_interfaces {
+    name            = "br0"
+    subnet_cidr     = "10.10.0.0/24"
+    default_gateway = true
+    bridge {
+      parent = "bond0"
+    }
+  }
+}
+
+resource "maas_instance" "ephemeral" {
+  allocate_params {
+    pod_type      = "lxd"
+    min_cpu_count = 4
+    min_memory    = 8192
+  }
+  compose_if_needed = true
+}
+
+resource "maas_instance" "web" {
+  allocate_params {
+    tags = ["web"]
+  }
+  deploy_params {
+    distro_series = "noble"
+    cloud_init_part {
+      content = yamlencode({
+        packages = ["nginx"]
+      })
+      merge_type = "list(append)+dict(no_replace,recurse_list)+str()"
+    }
+    cloud_init_part {
+      content_type = "text/x-shellscript"
+      filename     = "enable-nginx.sh"
+      content      = file("${path.module}/enable-nginx.sh")
+    }
+  }
+}
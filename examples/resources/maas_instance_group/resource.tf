@@ -0,0 +1,20 @@
+resource "maas_instance_group" "compute" {
+  name               = "compute"
+  size               = 50
+  min_healthy        = 45
+  rolling_batch_size = 10
+
+  allocate_params {
+    pool = "compute"
+    tags = ["compute"]
+  }
+  deploy_params {
+    distro_series = "noble"
+    user_data     = file("${path.module}/compute-user-data.yaml")
+  }
+
+  member_overrides {
+    index    = 0
+    hostname = "compute-gateway"
+  }
+}
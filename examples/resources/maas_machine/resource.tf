@@ -6,3 +6,30 @@ resource "maas_machine" "virsh_vm1" {
   })
   pxe_mac_address = "52:54:00:89:f5:3e"
 }
+
+resource "maas_machine" "ipmi_node1" {
+  power_type = "ipmi"
+  power_ipmi {
+    power_address = "10.10.0.21"
+    power_user    = "admin"
+    power_pass    = "secret"
+  }
+  pxe_mac_address = "0c:c4:7a:3d:11:42"
+
+  force_delete = true
+  on_destroy {
+    secure_erase = true
+  }
+}
+
+resource "maas_machine" "legacy_server1" {
+  power_type       = "manual"
+  power_parameters = jsonencode({})
+  pxe_mac_address  = "52:54:00:16:78:ec"
+  hostname         = "legacy-server1"
+  deployed         = true
+
+  on_destroy {
+    action = "forget"
+  }
+}
@@ -7,3 +7,26 @@ resource "maas_vm_host" "kvm" {
     "kvm",
   ]
 }
+
+variable "lxd_trust_password" {
+  type      = string
+  sensitive = true
+}
+
+variable "lxd_host_disks" {
+  type = list(string)
+}
+
+resource "maas_vm_host" "lxd" {
+  type          = "lxd"
+  power_address = "10.113.1.25"
+  password      = var.lxd_trust_password
+  project       = "maas"
+
+  default_storage_pool = "fast"
+
+  # Refresh the VM host resources when the disks of the host change
+  refresh_triggers = {
+    disks = join(",", var.lxd_host_disks)
+  }
+}
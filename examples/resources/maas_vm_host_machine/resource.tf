@@ -8,3 +8,35 @@ resource "maas_vm_host_machine" "kvm" {
     size_gigabytes = 15
   }
 }
+
+resource "maas_vm_host_machine" "lxd" {
+  vm_host          = maas_vm_host.lxd.id
+  architecture     = "amd64/generic"
+  pinned_cores     = [4, 5, 6, 7]
+  memory           = 8192
+  hugepages_backed = true
+
+  storage_disks {
+    size_gigabytes = 20
+    boot           = true
+  }
+  storage_disks {
+    pool           = "fast"
+    size_gigabytes = 50
+    tags           = ["data"]
+  }
+
+  network_interfaces {
+    name         = "eth0"
+    subnet_cidr  = "10.10.0.0/24"
+    type         = "macvlan"
+    macvlan_mode = "bridge"
+  }
+
+  lifecycle {
+    precondition {
+      condition     = maas_vm_host.lxd.resources_cores_available >= 4 && maas_vm_host.lxd.resources_memory_available >= 8192
+      error_message = "The VM host doesn't have enough available cores and memory."
+    }
+  }
+}
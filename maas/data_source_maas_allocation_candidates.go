@@ -0,0 +1,98 @@
+package maas
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/canonical/gomaasclient/client"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+	"github.com/juju/gomaasapi/v2"
+)
+
+func dataSourceMaasAllocationCandidates() *schema.Resource {
+	dataSourceSchema := getAllocateParamsSchema(false)
+	dataSourceSchema["candidates"] = &schema.Schema{
+		Type:        schema.TypeList,
+		Computed:    true,
+		Description: "The machines matching the allocation constraints, in the order MAAS would allocate them. Defined below.",
+		Elem:        getMachinesMachineResource(),
+	}
+	dataSourceSchema["ids"] = &schema.Schema{
+		Type:        schema.TypeList,
+		Computed:    true,
+		Elem:        &schema.Schema{Type: schema.TypeString},
+		Description: "The system IDs of the machines matching the allocation constraints, in the order MAAS would allocate them.",
+	}
+	dataSourceSchema["max_candidates"] = &schema.Schema{
+		Type:             schema.TypeInt,
+		Optional:         true,
+		Default:          10,
+		ValidateDiagFunc: validation.ToDiagFunc(validation.IntAtLeast(1)),
+		Description:      "The maximum number of candidates returned. Each candidate is found with a dry-run allocation request. Defaults to `10`.",
+	}
+
+	return &schema.Resource{
+		ReadContext: dataSourceAllocationCandidatesRead,
+		Schema:      dataSourceSchema,
+	}
+}
+
+func dataSourceAllocationCandidatesRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*client.Client)
+
+	allocateParams := map[string]interface{}{}
+	for k := range getAllocateParamsSchema(false) {
+		allocateParams[k] = d.Get(k)
+	}
+	if err := validateAllocateParams(allocateParams); err != nil {
+		return diag.FromErr(err)
+	}
+	params := getMachinesAllocateParamsFromMap(allocateParams)
+	params.DryRun = true
+
+	// MAAS dry-run allocations return a single machine, so the candidates are
+	// found one at a time, excluding the ones already found
+	ids := []string{}
+	candidates := []map[string]interface{}{}
+	found := map[string]bool{}
+	for len(ids) < d.Get("max_candidates").(int) {
+		machine, _, err := allocateMachine(client, params)
+		if serverErr, ok := gomaasapi.GetServerError(err); ok && serverErr.StatusCode == http.StatusConflict {
+			break
+		}
+		if err != nil {
+			return diag.FromErr(err)
+		}
+		if found[machine.SystemID] {
+			break
+		}
+		found[machine.SystemID] = true
+		ids = append(ids, machine.SystemID)
+		candidates = append(candidates, getMachinesMachineState(*machine))
+		params.NotID = append(params.NotID, machine.SystemID)
+	}
+
+	d.SetId(strconv.Itoa(schema.HashString(fmt.Sprintf("%+v", *getMachinesAllocateParamsFromMap(allocateParams)))))
+	tfState := map[string]interface{}{
+		"candidates": candidates,
+		"ids":        ids,
+	}
+	if err := setTerraformState(d, tfState); err != nil {
+		return diag.FromErr(err)
+	}
+	if len(ids) == 0 {
+		return diag.Diagnostics{
+			{
+				Severity: diag.Warning,
+				Summary:  "No machine matches the allocation constraints",
+				Detail:   "The allocation constraints cannot be satisfied by any available machine.",
+			},
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,288 @@
+package maas
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/gomaasclient/client"
+	"github.com/canonical/gomaasclient/entity"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+)
+
+func dataSourceMaasMachines() *schema.Resource {
+	return &schema.Resource{
+		Description: "Provides details about the existing MAAS machines matching the given filters.",
+		ReadContext: dataSourceMachinesRead,
+
+		Schema: map[string]*schema.Schema{
+			"architecture": {
+				Type:        schema.TypeSet,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Only return the machines with one of the given architectures (e.g. `amd64/generic`).",
+			},
+			"domain": {
+				Type:        schema.TypeSet,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Only return the machines in one of the given domains.",
+			},
+			"hostname_regex": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				ValidateDiagFunc: validation.ToDiagFunc(validation.StringIsValidRegExp),
+				Description:      "Only return the machines whose hostname matches the given regular expression.",
+			},
+			"ids": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "The system IDs of the matching machines, sorted by hostname.",
+			},
+			"machines": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "The matching machines, sorted by hostname. Defined below.",
+				Elem:        getMachinesMachineResource(),
+			},
+			"not_tags": {
+				Type:        schema.TypeSet,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Only return the machines that have none of the given tags.",
+			},
+			"owner": {
+				Type:        schema.TypeSet,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Only return the machines owned by one of the given users.",
+			},
+			"pool": {
+				Type:        schema.TypeSet,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Only return the machines in one of the given resource pools.",
+			},
+			"status": {
+				Type:        schema.TypeSet,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Only return the machines with one of the given statuses (e.g. `Ready`, `Deployed` or `Failed deployment`).",
+			},
+			"tags": {
+				Type:        schema.TypeSet,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Only return the machines that have all the given tags.",
+			},
+			"zone": {
+				Type:        schema.TypeSet,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Only return the machines in one of the given zones.",
+			},
+		},
+	}
+}
+
+func dataSourceMachinesRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*client.Client)
+
+	params := getMachinesParams(d)
+	machines, err := client.Machines.Get(params)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	// The MAAS API cannot match hostnames against a regular expression
+	var hostnameRegex *regexp.Regexp
+	if v, ok := d.GetOk("hostname_regex"); ok {
+		hostnameRegex = regexp.MustCompile(v.(string))
+	}
+	sort.Slice(machines, func(i, j int) bool {
+		return machines[i].Hostname < machines[j].Hostname
+	})
+	ids := []string{}
+	machinesState := []map[string]interface{}{}
+	for _, machine := range machines {
+		if hostnameRegex != nil && !hostnameRegex.MatchString(machine.Hostname) {
+			continue
+		}
+		ids = append(ids, machine.SystemID)
+		machinesState = append(machinesState, getMachinesMachineState(machine))
+	}
+
+	d.SetId(strconv.Itoa(schema.HashString(fmt.Sprintf("%+v %s", *params, d.Get("hostname_regex")))))
+	tfState := map[string]interface{}{
+		"ids":      ids,
+		"machines": machinesState,
+	}
+	if err := setTerraformState(d, tfState); err != nil {
+		return diag.FromErr(err)
+	}
+
+	return nil
+}
+
+// getMachinesMachineResource returns the schema of the machines listed by the
+// data sources.
+func getMachinesMachineResource() *schema.Resource {
+	return &schema.Resource{
+		Schema: map[string]*schema.Schema{
+			"architecture": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The architecture type of the machine.",
+			},
+			"cpu_count": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The number of CPU cores of the machine.",
+			},
+			"cpu_speed": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The CPU speed of the machine, in MHz.",
+			},
+			"domain": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The domain of the machine.",
+			},
+			"fqdn": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The fully qualified domain name of the machine.",
+			},
+			"hardware_uuid": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The hardware UUID of the machine.",
+			},
+			"hostname": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The machine hostname.",
+			},
+			"id": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The system ID of the machine.",
+			},
+			"ip_addresses": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "The IP addresses of the machine.",
+			},
+			"memory": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The RAM memory of the machine, in MB.",
+			},
+			"owner": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The user owning the machine, if it's allocated.",
+			},
+			"pool": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The resource pool of the machine.",
+			},
+			"power_state": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The power state of the machine.",
+			},
+			"power_type": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The power management type (e.g. `ipmi`) of the machine.",
+			},
+			"pxe_mac_address": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The MAC address of the machine's PXE boot NIC.",
+			},
+			"status": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The status of the machine (e.g. `Ready`).",
+			},
+			"storage": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The total storage of the machine, in MB.",
+			},
+			"tags": {
+				Type:        schema.TypeSet,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "The tags of the machine.",
+			},
+			"zone": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The zone of the machine.",
+			},
+		},
+	}
+}
+
+func getMachinesParams(d *schema.ResourceData) *entity.MachinesParams {
+	getSet := func(key string) []string {
+		return convertToStringSlice(d.Get(key).(*schema.Set).List())
+	}
+
+	params := &entity.MachinesParams{
+		Arch:    getSet("architecture"),
+		Domain:  getSet("domain"),
+		NotTags: getSet("not_tags"),
+		Owner:   getSet("owner"),
+		Pool:    getSet("pool"),
+		Tags:    getSet("tags"),
+		Zone:    getSet("zone"),
+	}
+	// The MAAS API filters the machines by the status keys (e.g. failed_deployment)
+	for _, status := range getSet("status") {
+		params.Status = append(params.Status, strings.ReplaceAll(strings.ToLower(strings.TrimSpace(status)), " ", "_"))
+	}
+
+	return params
+}
+
+func getMachinesMachineState(machine entity.Machine) map[string]interface{} {
+	ipAddresses := make([]string, len(machine.IPAddresses))
+	for i, ip := range machine.IPAddresses {
+		ipAddresses[i] = ip.String()
+	}
+
+	return map[string]interface{}{
+		"architecture":    machine.Architecture,
+		"cpu_count":       machine.CPUCount,
+		"cpu_speed":       machine.CPUSpeed,
+		"domain":          machine.Domain.Name,
+		"fqdn":            machine.FQDN,
+		"hardware_uuid":   machine.HardwareUUID,
+		"hostname":        machine.Hostname,
+		"id":              machine.SystemID,
+		"ip_addresses":    ipAddresses,
+		"memory":          machine.Memory,
+		"owner":           machine.Owner,
+		"pool":            machine.Pool.Name,
+		"power_state":     machine.PowerState,
+		"power_type":      machine.PowerType,
+		"pxe_mac_address": machine.BootInterface.MACAddress,
+		"status":          machine.StatusName,
+		"storage":         int(machine.Storage),
+		"tags":            machine.TagNames,
+		"zone":            machine.Zone.Name,
+	}
+}
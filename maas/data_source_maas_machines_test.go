@@ -0,0 +1,52 @@
+package maas_test
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"terraform-provider-maas/maas/testutils"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+)
+
+func TestAccDataSourceMaasMachines_basic(t *testing.T) {
+
+	machine := os.Getenv("TF_ACC_NETWORK_INTERFACE_MACHINE")
+
+	checks := []resource.TestCheckFunc{
+		resource.TestCheckResourceAttr("data.maas_machines.test", "ids.#", "1"),
+		resource.TestCheckResourceAttrPair("data.maas_machines.test", "ids.0", "data.maas_machine.test", "id"),
+		resource.TestCheckResourceAttr("data.maas_machines.test", "machines.#", "1"),
+		resource.TestCheckResourceAttr("data.maas_machines.test", "machines.0.hostname", machine),
+		resource.TestCheckResourceAttrPair("data.maas_machines.test", "machines.0.pool", "data.maas_machine.test", "pool"),
+		resource.TestCheckResourceAttrPair("data.maas_machines.test", "machines.0.zone", "data.maas_machine.test", "zone"),
+		resource.TestCheckResourceAttrSet("data.maas_machines.test", "machines.0.status"),
+	}
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:   func() { testutils.PreCheck(t, []string{"TF_ACC_NETWORK_INTERFACE_MACHINE"}) },
+		Providers:  testutils.TestAccProviders,
+		ErrorCheck: func(err error) error { return err },
+		Steps: []resource.TestStep{
+			{
+				Config: testAccDataSourceMaasMachines(machine),
+				Check:  resource.ComposeTestCheckFunc(checks...),
+			},
+		},
+	})
+}
+
+func testAccDataSourceMaasMachines(machine string) string {
+	return fmt.Sprintf(`
+data "maas_machine" "test" {
+	hostname = "%s"
+}
+
+data "maas_machines" "test" {
+	pool           = [data.maas_machine.test.pool]
+	zone           = [data.maas_machine.test.zone]
+	hostname_regex = "^%s$"
+}
+`, machine, regexp.QuoteMeta(machine))
+}
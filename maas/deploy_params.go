@@ -0,0 +1,399 @@
+package maas
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/canonical/gomaasclient/client"
+	"github.com/canonical/gomaasclient/entity"
+	"github.com/google/go-querystring/query"
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+	"github.com/juju/gomaasapi/v2"
+)
+
+// deployParamsMinVersions holds the minimum MAAS version supporting each
+// of the `deploy_params` options.
+var deployParamsMinVersions = map[string]string{
+	"enable_hw_sync":           "3.2",
+	"enable_kernel_crash_dump": "3.6",
+	"ephemeral":                "3.5",
+	"register_vmhost":          "3.0",
+}
+
+// machineDeployParams adds the deploy options not supported by gomaasclient.
+type machineDeployParams struct {
+	entity.MachineDeployParams
+	OSystem               string `url:"osystem,omitempty"`
+	BridgeType            string `url:"bridge_type,omitempty"`
+	VCenterRegistration   bool   `url:"vcenter_registration,omitempty"`
+	EnableKernelCrashDump bool   `url:"enable_kernel_crash_dump,omitempty"`
+}
+
+// getDeployParamsSchema returns the schema of the `deploy_params` blocks.
+func getDeployParamsSchema() map[string]*schema.Schema {
+	return map[string]*schema.Schema{
+		"bridge_all": {
+			Type:        schema.TypeBool,
+			Optional:    true,
+			Description: "Create a bridge on every configured network interface of the machine. Only used with `install_kvm` or `register_vmhost`.",
+		},
+		"bridge_fd": {
+			Type:        schema.TypeInt,
+			Optional:    true,
+			Description: "The bridge forward delay, in seconds. Only used with `bridge_all`.",
+		},
+		"bridge_stp": {
+			Type:        schema.TypeBool,
+			Optional:    true,
+			Description: "Enable the spanning tree protocol on the bridges. Only used with `bridge_all`.",
+		},
+		"bridge_type": {
+			Type:             schema.TypeString,
+			Optional:         true,
+			ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice([]string{"standard", "ovs"}, false)),
+			Description:      "The type of the bridges. Supported values are: `standard`, `ovs`. Only used with `bridge_all`. If it's not given, the MAAS server default value is used.",
+		},
+		"cloud_init_part": {
+			Type:          schema.TypeList,
+			Optional:      true,
+			ConflictsWith: []string{"deploy_params.0.user_data", "deploy_params.0.user_data_base64"},
+			Description:   "The parts of a MIME multipart cloud-init user data, assembled in the given order. It conflicts with `user_data` and `user_data_base64`. Defined below.",
+			Elem: &schema.Resource{
+				Schema: map[string]*schema.Schema{
+					"content": {
+						Type:        schema.TypeString,
+						Required:    true,
+						Description: "The content of the part.",
+					},
+					"content_type": {
+						Type:        schema.TypeString,
+						Optional:    true,
+						Default:     "text/cloud-config",
+						Description: "The MIME type of the part (e.g. `text/cloud-config` or `text/x-shellscript`). Defaults to `text/cloud-config`.",
+					},
+					"filename": {
+						Type:        schema.TypeString,
+						Optional:    true,
+						Description: "The filename of the part.",
+					},
+					"merge_type": {
+						Type:        schema.TypeString,
+						Optional:    true,
+						Description: "The cloud-init merge type of the part (e.g. `list(append)+dict(no_replace,recurse_list)+str()`).",
+					},
+				},
+			},
+		},
+		"distro_series": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "The distro series used to deploy the allocated MAAS machine. If it's not given, the MAAS server default value is used.",
+		},
+		"enable_hw_sync": {
+			Type:        schema.TypeBool,
+			Optional:    true,
+			Description: "Periodically sync hardware",
+		},
+		"enable_kernel_crash_dump": {
+			Type:        schema.TypeBool,
+			Optional:    true,
+			Description: "Enable the kernel crash dump on the deployed machine (MAAS 3.6 or later).",
+		},
+		"ephemeral": {
+			Type:        schema.TypeBool,
+			Optional:    true,
+			Description: "Deploy machine in memory",
+		},
+		"hwe_kernel": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "Hardware enablement kernel to use with the image. Only used when deploying Ubuntu.",
+		},
+		"install_kvm": {
+			Type:          schema.TypeBool,
+			Optional:      true,
+			ConflictsWith: []string{"deploy_params.0.register_vmhost"},
+			Description:   "Install KVM on the machine and register it as a virsh VM host. It conflicts with `register_vmhost`.",
+		},
+		"kernel_opts": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "The kernel command line options used to boot the machine. MAAS doesn't support per-machine kernel options, so they are set with a `kernel-opts-<system_id>` tag applied to the machine only, which is deleted when the instance is destroyed.",
+		},
+		"osystem": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "The operating system (e.g. `ubuntu`, `centos`, `rhel` or `custom`) used to deploy the allocated MAAS machine. If it's not given, the MAAS server default value is used.",
+		},
+		"register_vmhost": {
+			Type:          schema.TypeBool,
+			Optional:      true,
+			ConflictsWith: []string{"deploy_params.0.install_kvm"},
+			Description:   "Install LXD on the machine and register it as a LXD VM host (MAAS 3.0 or later). It conflicts with `install_kvm`.",
+		},
+		"user_data": {
+			Type:          schema.TypeString,
+			Optional:      true,
+			ConflictsWith: []string{"deploy_params.0.user_data_base64"},
+			Description:   "Cloud-init user data script that gets run on the machine once it has deployed. A good practice is to set this with `file(\"/tmp/user-data.txt\")`, where `/tmp/user-data.txt` is a cloud-init script. It's always base64 encoded by the provider, use `user_data_base64` for the content that is encoded already.",
+		},
+		"user_data_base64": {
+			Type:             schema.TypeString,
+			Optional:         true,
+			ValidateDiagFunc: validation.ToDiagFunc(validation.StringIsBase64),
+			Description:      "Base64 encoded cloud-init user data, sent to MAAS as is (e.g. `filebase64(\"/tmp/user-data.gz\")`). It conflicts with `user_data`.",
+		},
+		"vcenter_registration": {
+			Type:        schema.TypeBool,
+			Optional:    true,
+			Description: "Register the deployed VMware ESXi machine with the vCenter configured in MAAS. Only used when deploying ESXi.",
+		},
+	}
+}
+
+// cloudInitBoundary is the boundary of the multipart user data. It's fixed so
+// the user data is the same for the same parts.
+const cloudInitBoundary = "MIMEBOUNDARY"
+
+// getDeployUserData returns the base64 encoded user data of the deploy
+// params, from `user_data_base64`, `cloud_init_part` or `user_data`.
+func getDeployUserData(deployParams map[string]interface{}) (string, error) {
+	if userData, ok := deployParams["user_data_base64"].(string); ok && userData != "" {
+		return userData, nil
+	}
+	if parts, ok := deployParams["cloud_init_part"].([]interface{}); ok && len(parts) > 0 {
+		userData, err := renderCloudInitMultipart(parts)
+		if err != nil {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString([]byte(userData)), nil
+	}
+	return base64.StdEncoding.EncodeToString([]byte(deployParams["user_data"].(string))), nil
+}
+
+// renderCloudInitMultipart assembles the cloud-init parts in a MIME multipart
+// document, like the `cloudinit_config` data source of the cloudinit provider.
+func renderCloudInitMultipart(parts []interface{}) (string, error) {
+	var b bytes.Buffer
+	writer := multipart.NewWriter(&b)
+	if err := writer.SetBoundary(cloudInitBoundary); err != nil {
+		return "", err
+	}
+	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=\"%s\"\r\nMIME-Version: 1.0\r\n\r\n", cloudInitBoundary)
+
+	for _, part := range parts {
+		p := part.(map[string]interface{})
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", p["content_type"].(string))
+		header.Set("Content-Transfer-Encoding", "7bit")
+		header.Set("MIME-Version", "1.0")
+		if filename := p["filename"].(string); filename != "" {
+			header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+		}
+		if mergeType := p["merge_type"].(string); mergeType != "" {
+			header.Set("X-Merge-Type", mergeType)
+		}
+		w, err := writer.CreatePart(header)
+		if err != nil {
+			return "", err
+		}
+		if _, err := w.Write([]byte(p["content"].(string))); err != nil {
+			return "", err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// deployMachine deploys the allocated machine. The deploy options are not
+// all supported by gomaasclient, so the machine is deployed with the MAAS API
+// client directly.
+func deployMachine(client *client.Client, systemID string, params *machineDeployParams) (*entity.Machine, error) {
+	apiClient, err := getAPIClient(client)
+	if err != nil {
+		return nil, err
+	}
+	qsp, err := query.Values(params)
+	if err != nil {
+		return nil, err
+	}
+
+	machine := new(entity.Machine)
+	err = apiClient.GetSubObject("machines").GetSubObject(systemID).Post("deploy", qsp, func(data []byte) error {
+		return json.Unmarshal(data, machine)
+	})
+	return machine, err
+}
+
+// maasVersionCache holds the version of each configured MAAS client, so it's
+// fetched only once per Terraform run.
+var maasVersionCache = struct {
+	sync.Mutex
+	versions map[*client.Client]*version.Version
+}{versions: map[*client.Client]*version.Version{}}
+
+func getMAASVersion(client *client.Client) (*version.Version, error) {
+	maasVersionCache.Lock()
+	defer maasVersionCache.Unlock()
+
+	if v, ok := maasVersionCache.versions[client]; ok {
+		return v, nil
+	}
+	maasVersion, err := client.Version.Get()
+	if err != nil {
+		return nil, err
+	}
+	v, err := parseMAASVersion(maasVersion.Version)
+	if err != nil {
+		return nil, err
+	}
+	maasVersionCache.versions[client] = v
+
+	return v, nil
+}
+
+// parseMAASVersion parses MAAS versions, ignoring the pre-release and build
+// details (e.g. `3.5.0~rc1` or `3.4.2-14353-g.5a5221d57`).
+func parseMAASVersion(v string) (*version.Version, error) {
+	if i := strings.IndexAny(v, "~-+ "); i >= 0 {
+		v = v[:i]
+	}
+	return version.NewVersion(v)
+}
+
+// validateDeployParams checks the deploy options are supported by the MAAS
+// version, and that the image to be deployed is synced by MAAS.
+func validateDeployParams(client *client.Client, deployParams map[string]interface{}) error {
+	var options []string
+	for option := range deployParamsMinVersions {
+		if v, ok := deployParams[option].(bool); ok && v {
+			options = append(options, option)
+		}
+	}
+	if len(options) > 0 {
+		maasVersion, err := getMAASVersion(client)
+		if err != nil {
+			return err
+		}
+		sort.Strings(options)
+		for _, option := range options {
+			minVersion := version.Must(version.NewVersion(deployParamsMinVersions[option]))
+			if maasVersion.LessThan(minVersion) {
+				return fmt.Errorf("deploy_params: '%s' requires MAAS %s or later, the MAAS version is %s", option, minVersion, maasVersion)
+			}
+		}
+	}
+
+	osystem := deployParams["osystem"].(string)
+	distroSeries := deployParams["distro_series"].(string)
+	if osystem == "" && distroSeries == "" {
+		return nil
+	}
+
+	bootResources, err := client.BootResources.Get(&entity.BootResourcesReadParams{})
+	if err != nil {
+		// Only the admin users can list the boot resources
+		if serverErr, ok := gomaasapi.GetServerError(err); ok && serverErr.StatusCode == http.StatusForbidden {
+			return nil
+		}
+		return err
+	}
+	names := make([]string, len(bootResources))
+	for i, bootResource := range bootResources {
+		names[i] = bootResource.Name
+	}
+
+	return validateDeployImage(names, osystem, distroSeries)
+}
+
+// validateDeployImage checks the OS, and release, to be deployed match one
+// of the given boot resources. The custom images may be named without the
+// `custom/` prefix.
+func validateDeployImage(bootResources []string, osystem string, distroSeries string) error {
+	if osystem == "" && distroSeries == "" {
+		return nil
+	}
+	available := map[string]bool{}
+	for _, name := range bootResources {
+		available[name] = true
+		if !strings.Contains(name, "/") {
+			available["custom/"+name] = true
+		}
+	}
+
+	switch {
+	case osystem != "" && distroSeries != "":
+		if available[osystem+"/"+distroSeries] {
+			return nil
+		}
+	case osystem != "":
+		for name := range available {
+			if strings.HasPrefix(name, osystem+"/") {
+				return nil
+			}
+		}
+	default:
+		for name := range available {
+			if strings.HasSuffix(name, "/"+distroSeries) {
+				return nil
+			}
+		}
+	}
+
+	names := append([]string{}, bootResources...)
+	sort.Strings(names)
+	image := strings.Trim(osystem+"/"+distroSeries, "/")
+	return fmt.Errorf("deploy_params: image (%s) is not synced by MAAS, the available images are: %s", image, strings.Join(names, ", "))
+}
+
+// getKernelOptsTagName returns the name of the tag holding the kernel
+// options of the given machine. MAAS doesn't support per-machine kernel
+// options, so they are set with a tag applied to the machine only.
+func getKernelOptsTagName(systemID string) string {
+	return fmt.Sprintf("kernel-opts-%s", systemID)
+}
+
+func setMachineKernelOpts(client *client.Client, systemID string, kernelOpts string) error {
+	tagName := getKernelOptsTagName(systemID)
+	tagParams := &entity.TagParams{
+		Name:       tagName,
+		Comment:    "Kernel options set by Terraform",
+		KernelOpts: kernelOpts,
+	}
+	// The tag is left behind by a failed or interrupted deployment, so it's
+	// updated if it already exists
+	tag, err := findTag(client, tagName)
+	if err != nil {
+		return err
+	}
+	if tag == nil {
+		_, err = client.Tags.Create(tagParams)
+	} else {
+		_, err = client.Tag.Update(tagName, tagParams)
+	}
+	if err != nil {
+		return err
+	}
+	return client.Tag.AddMachines(tagName, []string{systemID})
+}
+
+func deleteMachineKernelOpts(client *client.Client, systemID string) error {
+	err := client.Tag.Delete(getKernelOptsTagName(systemID))
+	if serverErr, ok := gomaasapi.GetServerError(err); ok && serverErr.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
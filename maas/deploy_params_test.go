@@ -0,0 +1,86 @@
+package maas
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMAASVersion(t *testing.T) {
+	for v, expected := range map[string]string{
+		"3.4.2":                    "3.4.2",
+		"3.5.0~rc1":                "3.5.0",
+		"3.4.2-14353-g.5a5221d57":  "3.4.2",
+		"3.6.0~beta3-17038-g.7e7d": "3.6.0",
+	} {
+		parsed, err := parseMAASVersion(v)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, parsed.String())
+	}
+}
+
+func TestValidateDeployImage(t *testing.T) {
+	bootResources := []string{"ubuntu/jammy", "ubuntu/noble", "centos/centos8-stream", "rhel9"}
+
+	testCases := []struct {
+		name         string
+		osystem      string
+		distroSeries string
+		valid        bool
+	}{
+		{name: "default image", valid: true},
+		{name: "os and release", osystem: "ubuntu", distroSeries: "noble", valid: true},
+		{name: "os only", osystem: "centos", valid: true},
+		{name: "release only", distroSeries: "jammy", valid: true},
+		{name: "custom image", osystem: "custom", distroSeries: "rhel9", valid: true},
+		{name: "release not synced", osystem: "ubuntu", distroSeries: "focal"},
+		{name: "os not synced", osystem: "rhel"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := validateDeployImage(bootResources, testCase.osystem, testCase.distroSeries)
+			if testCase.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestGetDeployUserData(t *testing.T) {
+	userData, err := getDeployUserData(map[string]interface{}{"user_data": "#cloud-config\n", "user_data_base64": ""})
+	assert.NoError(t, err)
+	assert.Equal(t, "I2Nsb3VkLWNvbmZpZwo=", userData)
+
+	// Valid base64 is encoded as well
+	userData, err = getDeployUserData(map[string]interface{}{"user_data": "ZGF0YQ==", "user_data_base64": ""})
+	assert.NoError(t, err)
+	assert.Equal(t, "WkdGMFlRPT0=", userData)
+
+	userData, err = getDeployUserData(map[string]interface{}{"user_data": "", "user_data_base64": "H4sIAAAAAAAA/w=="})
+	assert.NoError(t, err)
+	assert.Equal(t, "H4sIAAAAAAAA/w==", userData)
+
+	userData, err = getDeployUserData(map[string]interface{}{
+		"user_data":        "",
+		"user_data_base64": "",
+		"cloud_init_part": []interface{}{
+			map[string]interface{}{"content": "#cloud-config\npackages: [jq]\n", "content_type": "text/cloud-config", "filename": "", "merge_type": "list(append)+dict(recurse_array)+str()"},
+			map[string]interface{}{"content": "#!/bin/sh\necho hello\n", "content_type": "text/x-shellscript", "filename": "hello.sh", "merge_type": ""},
+		},
+	})
+	assert.NoError(t, err)
+	decoded, err := base64.StdEncoding.DecodeString(userData)
+	assert.NoError(t, err)
+	assert.Equal(t, "Content-Type: multipart/mixed; boundary=\"MIMEBOUNDARY\"\r\nMIME-Version: 1.0\r\n\r\n"+
+		"--MIMEBOUNDARY\r\n"+
+		"Content-Transfer-Encoding: 7bit\r\nContent-Type: text/cloud-config\r\nMime-Version: 1.0\r\nX-Merge-Type: list(append)+dict(recurse_array)+str()\r\n\r\n"+
+		"#cloud-config\npackages: [jq]\n\r\n"+
+		"--MIMEBOUNDARY\r\n"+
+		"Content-Disposition: attachment; filename=\"hello.sh\"\r\nContent-Transfer-Encoding: 7bit\r\nContent-Type: text/x-shellscript\r\nMime-Version: 1.0\r\n\r\n"+
+		"#!/bin/sh\necho hello\n\r\n"+
+		"--MIMEBOUNDARY--\r\n", string(decoded))
+}
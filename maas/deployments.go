@@ -0,0 +1,94 @@
+package maas
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/canonical/gomaasclient/client"
+	"golang.org/x/sync/semaphore"
+)
+
+// deploymentSemaphores holds the semaphore limiting the simultaneous
+// deployments, and commissionings, of each configured MAAS client.
+var deploymentSemaphores = struct {
+	sync.Mutex
+	semaphores map[*client.Client]*deploymentSemaphore
+}{semaphores: map[*client.Client]*deploymentSemaphore{}}
+
+type deploymentSemaphore struct {
+	*semaphore.Weighted
+	size int
+}
+
+// deploymentQueueLogInterval is the interval between the logs of the queued
+// operations.
+var deploymentQueueLogInterval = 30 * time.Second
+
+func setMaxParallelDeployments(client *client.Client, maxParallelDeployments int) {
+	deploymentSemaphores.Lock()
+	defer deploymentSemaphores.Unlock()
+
+	if maxParallelDeployments <= 0 {
+		delete(deploymentSemaphores.semaphores, client)
+		return
+	}
+	deploymentSemaphores.semaphores[client] = &deploymentSemaphore{
+		Weighted: semaphore.NewWeighted(int64(maxParallelDeployments)),
+		size:     maxParallelDeployments,
+	}
+}
+
+func getDeploymentSemaphore(client *client.Client) *deploymentSemaphore {
+	deploymentSemaphores.Lock()
+	defer deploymentSemaphores.Unlock()
+
+	return deploymentSemaphores.semaphores[client]
+}
+
+// getMaxParallelDeployments returns the `max_parallel_deployments` of the
+// provider, or 0 when the deployments are not limited.
+func getMaxParallelDeployments(client *client.Client) int {
+	if sem := getDeploymentSemaphore(client); sem != nil {
+		return sem.size
+	}
+	return 0
+}
+
+// acquireDeploymentSlots waits for the given number of deployment slots, and
+// returns the function releasing them. The slots must be held from the start
+// of the deployment, or commissioning, until the machines reach a terminal
+// state. The slots are acquired all at once, so that groups of machines
+// cannot starve each other.
+func acquireDeploymentSlots(ctx context.Context, client *client.Client, slots int, operation string) (func(), error) {
+	sem := getDeploymentSemaphore(client)
+	if sem == nil || slots == 0 {
+		return func() {}, nil
+	}
+	if slots > sem.size {
+		slots = sem.size
+	}
+	release := func() {
+		sem.Release(int64(slots))
+	}
+	if sem.TryAcquire(int64(slots)) {
+		return release, nil
+	}
+
+	log.Printf("[INFO] %s is queued, waiting for %d of the %d deployment slots\n", operation, slots, sem.size)
+	start := time.Now()
+	for {
+		waitCtx, cancel := context.WithTimeout(ctx, deploymentQueueLogInterval)
+		err := sem.Acquire(waitCtx, int64(slots))
+		cancel()
+		if err == nil {
+			log.Printf("[INFO] %s acquired %d deployment slots after %s\n", operation, slots, time.Since(start).Round(time.Second))
+			return release, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		log.Printf("[INFO] %s is still queued after %s, waiting for %d of the %d deployment slots\n", operation, time.Since(start).Round(time.Second), slots, sem.size)
+	}
+}
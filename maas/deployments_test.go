@@ -0,0 +1,46 @@
+package maas
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/canonical/gomaasclient/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcquireDeploymentSlots(t *testing.T) {
+	c := &client.Client{}
+	ctx := context.Background()
+
+	// Unlimited deployments
+	release, err := acquireDeploymentSlots(ctx, c, 10, "test")
+	assert.NoError(t, err)
+	release()
+
+	setMaxParallelDeployments(c, 2)
+	defer setMaxParallelDeployments(c, 0)
+	assert.Equal(t, 2, getMaxParallelDeployments(c))
+
+	releaseFirst, err := acquireDeploymentSlots(ctx, c, 1, "first")
+	assert.NoError(t, err)
+	releaseSecond, err := acquireDeploymentSlots(ctx, c, 1, "second")
+	assert.NoError(t, err)
+
+	// The third deployment is queued until a slot is released
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = acquireDeploymentSlots(timeoutCtx, c, 1, "third")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	releaseFirst()
+	releaseThird, err := acquireDeploymentSlots(ctx, c, 1, "third")
+	assert.NoError(t, err)
+	releaseSecond()
+	releaseThird()
+
+	// The groups larger than the limit wait for all the slots
+	releaseGroup, err := acquireDeploymentSlots(ctx, c, 5, "group")
+	assert.NoError(t, err)
+	releaseGroup()
+}
@@ -0,0 +1,678 @@
+package maas
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/gomaasclient/client"
+	"github.com/canonical/gomaasclient/entity"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// ExportResourceTypes lists the resource types supported by Export, in the
+// order they are exported. Resources only reference the ones exported before.
+var ExportResourceTypes = []string{
+	"maas_resource_pool",
+	"maas_fabric",
+	"maas_vlan",
+	"maas_subnet",
+	"maas_subnet_ip_range",
+	"maas_machine",
+	"maas_block_device",
+	"maas_tag",
+	"maas_vm_host",
+	"maas_dns_record",
+}
+
+var exportInvalidNameChars = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+type exporter struct {
+	client    *client.Client
+	resources map[string]*hclwrite.File
+	imports   *hclwrite.File
+	variables *hclwrite.File
+	// names holds the Terraform resource names already used, per resource type
+	names map[string]map[string]bool
+	// refs maps the MAAS identifiers of the exported objects to their
+	// Terraform resource names, per resource type
+	refs map[string]map[string]string
+}
+
+// Export walks the MAAS API and writes, into the output directory, one `.tf`
+// file per resource type together with an `imports.tf` file holding the
+// `import` blocks used to adopt the existing MAAS objects. References between
+// the exported objects are rendered as Terraform references. Secret power
+// parameters are not written, they are declared as sensitive variables in
+// `variables.tf` instead.
+func Export(client *client.Client, resourceTypes []string, outputDir string) error {
+	selected := map[string]bool{}
+	for _, resourceType := range resourceTypes {
+		if !isExportResourceType(resourceType) {
+			return fmt.Errorf("resource type (%s) cannot be exported, expected one of: %s", resourceType, strings.Join(ExportResourceTypes, ", "))
+		}
+		selected[resourceType] = true
+	}
+
+	e := &exporter{
+		client:    client,
+		resources: map[string]*hclwrite.File{},
+		imports:   hclwrite.NewEmptyFile(),
+		variables: hclwrite.NewEmptyFile(),
+		names:     map[string]map[string]bool{},
+		refs:      map[string]map[string]string{},
+	}
+	exportFuncs := map[string]func() error{
+		"maas_resource_pool":   e.exportResourcePools,
+		"maas_fabric":          e.exportFabrics,
+		"maas_vlan":            e.exportVlans,
+		"maas_subnet":          e.exportSubnets,
+		"maas_subnet_ip_range": e.exportSubnetIPRanges,
+		"maas_machine":         e.exportMachines,
+		"maas_block_device":    e.exportBlockDevices,
+		"maas_tag":             e.exportTags,
+		"maas_vm_host":         e.exportVMHosts,
+		"maas_dns_record":      e.exportDNSRecords,
+	}
+	for _, resourceType := range ExportResourceTypes {
+		if !selected[resourceType] {
+			continue
+		}
+		if err := exportFuncs[resourceType](); err != nil {
+			return fmt.Errorf("failed to export %s resources: %w", resourceType, err)
+		}
+		log.Printf("[INFO] Exported %d %s resources\n", len(e.refs[resourceType]), resourceType)
+	}
+
+	return e.write(outputDir)
+}
+
+func isExportResourceType(resourceType string) bool {
+	for _, t := range ExportResourceTypes {
+		if t == resourceType {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *exporter) write(outputDir string) error {
+	files := map[string]*hclwrite.File{}
+	for resourceType, f := range e.resources {
+		files[resourceType+".tf"] = f
+	}
+	if len(e.imports.Body().Blocks()) > 0 {
+		files["imports.tf"] = e.imports
+	}
+	if len(e.variables.Body().Blocks()) > 0 {
+		files["variables.tf"] = e.variables
+	}
+
+	// Never overwrite existing configuration
+	for name := range files {
+		path := filepath.Join(outputDir, name)
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("file (%s) already exists", path)
+		}
+	}
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return err
+	}
+	for name, f := range files {
+		if err := os.WriteFile(filepath.Join(outputDir, name), f.Bytes(), 0o644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addResource appends a new resource block, and its import block, and returns
+// the resource block body. The Terraform resource name is derived from the
+// given name and is registered as the reference of the MAAS object ID.
+func (e *exporter) addResource(resourceType string, name string, maasID string, importID string) *hclwrite.Body {
+	resourceName := e.resourceName(resourceType, name)
+	if e.refs[resourceType] == nil {
+		e.refs[resourceType] = map[string]string{}
+	}
+	e.refs[resourceType][maasID] = resourceName
+
+	f, ok := e.resources[resourceType]
+	if !ok {
+		f = hclwrite.NewEmptyFile()
+		e.resources[resourceType] = f
+	} else {
+		f.Body().AppendNewline()
+	}
+	block := f.Body().AppendNewBlock("resource", []string{resourceType, resourceName})
+
+	if len(e.imports.Body().Blocks()) > 0 {
+		e.imports.Body().AppendNewline()
+	}
+	importBody := e.imports.Body().AppendNewBlock("import", nil).Body()
+	importBody.SetAttributeTraversal("to", hcl.Traversal{
+		hcl.TraverseRoot{Name: resourceType},
+		hcl.TraverseAttr{Name: resourceName},
+	})
+	importBody.SetAttributeValue("id", cty.StringVal(importID))
+
+	return block.Body()
+}
+
+func (e *exporter) resourceName(resourceType string, name string) string {
+	resourceName := strings.Trim(exportInvalidNameChars.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if resourceName == "" || (resourceName[0] >= '0' && resourceName[0] <= '9') || resourceName[0] == '-' {
+		resourceName = "_" + resourceName
+	}
+	if e.names[resourceType] == nil {
+		e.names[resourceType] = map[string]bool{}
+	}
+	uniqueName := resourceName
+	for i := 2; e.names[resourceType][uniqueName]; i++ {
+		uniqueName = fmt.Sprintf("%s_%d", resourceName, i)
+	}
+	e.names[resourceType][uniqueName] = true
+	return uniqueName
+}
+
+// reference returns a Terraform reference to the attribute of an exported
+// MAAS object, or the literal value if the object was not exported.
+func (e *exporter) reference(resourceType string, maasID string, attribute string, literal cty.Value) hclwrite.Tokens {
+	if resourceName, ok := e.refs[resourceType][maasID]; ok {
+		return hclwrite.TokensForTraversal(hcl.Traversal{
+			hcl.TraverseRoot{Name: resourceType},
+			hcl.TraverseAttr{Name: resourceName},
+			hcl.TraverseAttr{Name: attribute},
+		})
+	}
+	return hclwrite.TokensForValue(literal)
+}
+
+// sensitiveVariable declares a sensitive string variable and returns a
+// reference to it.
+func (e *exporter) sensitiveVariable(name string, description string) hclwrite.Tokens {
+	if len(e.variables.Body().Blocks()) > 0 {
+		e.variables.Body().AppendNewline()
+	}
+	body := e.variables.Body().AppendNewBlock("variable", []string{name}).Body()
+	body.SetAttributeTraversal("type", hcl.Traversal{hcl.TraverseRoot{Name: "string"}})
+	body.SetAttributeValue("description", cty.StringVal(description))
+	body.SetAttributeValue("sensitive", cty.True)
+	return hclwrite.TokensForTraversal(hcl.Traversal{
+		hcl.TraverseRoot{Name: "var"},
+		hcl.TraverseAttr{Name: name},
+	})
+}
+
+// exportIndex maps the identifiers accepted by a resource importer to the
+// MAAS IDs of the objects they resolve to. It's built from the objects listed
+// once, instead of looking up every candidate import ID through the API.
+type exportIndex map[string]string
+
+// add registers the identifiers of a MAAS object. The importers return the
+// first listed object matching an identifier, so the objects are added in
+// the order listed by MAAS and an identifier already registered is kept.
+func (i exportIndex) add(maasID string, identifiers ...string) {
+	for _, identifier := range identifiers {
+		if _, ok := i[identifier]; !ok {
+			i[identifier] = maasID
+		}
+	}
+}
+
+// importID returns the first candidate import ID which resolves to the
+// exported MAAS object. The last candidate is expected to be unambiguous, and
+// it is returned if none of the others resolves.
+func importID(maasID string, index exportIndex, candidates ...string) string {
+	for _, candidate := range candidates[:len(candidates)-1] {
+		if id, ok := index[candidate]; ok && id == maasID {
+			return candidate
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+func (e *exporter) exportResourcePools() error {
+	resourcePools, err := e.client.ResourcePools.Get()
+	if err != nil {
+		return err
+	}
+	index := exportIndex{}
+	for _, resourcePool := range resourcePools {
+		index.add(fmt.Sprintf("%v", resourcePool.ID), fmt.Sprintf("%v", resourcePool.ID), resourcePool.Name)
+	}
+	sort.Slice(resourcePools, func(i, j int) bool { return resourcePools[i].Name < resourcePools[j].Name })
+	for _, resourcePool := range resourcePools {
+		id := fmt.Sprintf("%v", resourcePool.ID)
+		body := e.addResource("maas_resource_pool", resourcePool.Name, id, importID(id, index, resourcePool.Name, id))
+		body.SetAttributeValue("name", cty.StringVal(resourcePool.Name))
+		if resourcePool.Description != "" {
+			body.SetAttributeValue("description", cty.StringVal(resourcePool.Description))
+		}
+	}
+	return nil
+}
+
+func (e *exporter) exportFabrics() error {
+	fabrics, err := e.client.Fabrics.Get()
+	if err != nil {
+		return err
+	}
+	index := getFabricsExportIndex(fabrics)
+	sort.Slice(fabrics, func(i, j int) bool { return fabrics[i].Name < fabrics[j].Name })
+	for _, fabric := range fabrics {
+		id := fmt.Sprintf("%v", fabric.ID)
+		body := e.addResource("maas_fabric", fabric.Name, id, importID(id, index, fabric.Name, id))
+		body.SetAttributeValue("name", cty.StringVal(fabric.Name))
+	}
+	return nil
+}
+
+func (e *exporter) exportVlans() error {
+	fabrics, err := e.client.Fabrics.Get()
+	if err != nil {
+		return err
+	}
+	fabricsIndex := getFabricsExportIndex(fabrics)
+	fabricVlans := map[int][]entity.VLAN{}
+	for _, fabric := range fabrics {
+		vlans, err := e.client.VLANs.Get(fabric.ID)
+		if err != nil {
+			return err
+		}
+		fabricVlans[fabric.ID] = vlans
+	}
+
+	// The VLANs are imported as FABRIC:VLAN, the fabric is resolved first and
+	// the VLAN is then resolved within the VLANs of that fabric
+	index := exportIndex{}
+	for identifier, id := range fabricsIndex {
+		fabricID, _ := strconv.Atoi(id)
+		for _, vlan := range fabricVlans[fabricID] {
+			id := fmt.Sprintf("%v", vlan.ID)
+			index.add(id, fmt.Sprintf("%s:%v", identifier, vlan.VID), fmt.Sprintf("%s:%s", identifier, id))
+		}
+	}
+
+	sort.Slice(fabrics, func(i, j int) bool { return fabrics[i].Name < fabrics[j].Name })
+	for _, fabric := range fabrics {
+		vlans := fabricVlans[fabric.ID]
+		sort.Slice(vlans, func(i, j int) bool { return vlans[i].VID < vlans[j].VID })
+		fabricID := fmt.Sprintf("%v", fabric.ID)
+		for _, vlan := range vlans {
+			id := fmt.Sprintf("%v", vlan.ID)
+			vid := fmt.Sprintf("%v", vlan.VID)
+			body := e.addResource("maas_vlan", fmt.Sprintf("%s_%s", fabric.Name, vid), id, importID(id, index, fmt.Sprintf("%s:%s", fabric.Name, vid), fmt.Sprintf("%s:%s", fabricID, id)))
+			body.SetAttributeRaw("fabric", e.reference("maas_fabric", fabricID, "id", cty.StringVal(fabricID)))
+			body.SetAttributeValue("vid", cty.NumberIntVal(int64(vlan.VID)))
+			if vlan.Name != "" {
+				body.SetAttributeValue("name", cty.StringVal(vlan.Name))
+			}
+			body.SetAttributeValue("mtu", cty.NumberIntVal(int64(vlan.MTU)))
+			body.SetAttributeValue("dhcp_on", cty.BoolVal(vlan.DHCPOn))
+			if vlan.Space != "" && vlan.Space != "undefined" {
+				body.SetAttributeValue("space", cty.StringVal(vlan.Space))
+			}
+		}
+	}
+	return nil
+}
+
+func (e *exporter) exportSubnets() error {
+	subnets, err := e.client.Subnets.Get()
+	if err != nil {
+		return err
+	}
+	index := exportIndex{}
+	for _, subnet := range subnets {
+		index.add(fmt.Sprintf("%v", subnet.ID), fmt.Sprintf("%v", subnet.ID), subnet.CIDR)
+	}
+	sort.Slice(subnets, func(i, j int) bool { return subnets[i].CIDR < subnets[j].CIDR })
+	for _, subnet := range subnets {
+		id := fmt.Sprintf("%v", subnet.ID)
+		body := e.addResource("maas_subnet", subnet.CIDR, id, importID(id, index, subnet.CIDR, id))
+		body.SetAttributeValue("cidr", cty.StringVal(subnet.CIDR))
+		if subnet.Name != "" {
+			body.SetAttributeValue("name", cty.StringVal(subnet.Name))
+		}
+		fabricID := fmt.Sprintf("%v", subnet.VLAN.FabricID)
+		body.SetAttributeRaw("fabric", e.reference("maas_fabric", fabricID, "id", cty.StringVal(fabricID)))
+		// The VLAN is referenced by ID, since VIDs are only unique per fabric
+		vlanID := fmt.Sprintf("%v", subnet.VLAN.ID)
+		body.SetAttributeRaw("vlan", e.reference("maas_vlan", vlanID, "id", cty.StringVal(vlanID)))
+		if subnet.GatewayIP != nil {
+			body.SetAttributeValue("gateway_ip", cty.StringVal(subnet.GatewayIP.String()))
+		}
+		if len(subnet.DNSServers) > 0 {
+			dnsServers := make([]cty.Value, len(subnet.DNSServers))
+			for i, ip := range subnet.DNSServers {
+				dnsServers[i] = cty.StringVal(ip.String())
+			}
+			body.SetAttributeValue("dns_servers", cty.ListVal(dnsServers))
+		}
+		body.SetAttributeValue("rdns_mode", cty.NumberIntVal(int64(subnet.RDNSMode)))
+		body.SetAttributeValue("allow_dns", cty.BoolVal(subnet.AllowDNS))
+		body.SetAttributeValue("allow_proxy", cty.BoolVal(subnet.AllowProxy))
+	}
+	return nil
+}
+
+func (e *exporter) exportSubnetIPRanges() error {
+	ipRanges, err := e.client.IPRanges.Get()
+	if err != nil {
+		return err
+	}
+	index := exportIndex{}
+	for _, ipRange := range ipRanges {
+		index.add(fmt.Sprintf("%v", ipRange.ID), fmt.Sprintf("%s:%s", ipRange.StartIP, ipRange.EndIP))
+	}
+	sort.Slice(ipRanges, func(i, j int) bool { return ipRanges[i].ID < ipRanges[j].ID })
+	for _, ipRange := range ipRanges {
+		id := fmt.Sprintf("%v", ipRange.ID)
+		startIP := ipRange.StartIP.String()
+		endIP := ipRange.EndIP.String()
+		// IPv6 ranges cannot be imported as START_IP:END_IP
+		candidates := []string{id}
+		if ipRange.StartIP.To4() != nil {
+			candidates = []string{fmt.Sprintf("%s:%s", startIP, endIP), id}
+		}
+		body := e.addResource("maas_subnet_ip_range", fmt.Sprintf("%s_%s", ipRange.Type, startIP), id, importID(id, index, candidates...))
+		subnetID := fmt.Sprintf("%v", ipRange.Subnet.ID)
+		body.SetAttributeRaw("subnet", e.reference("maas_subnet", subnetID, "id", cty.StringVal(subnetID)))
+		body.SetAttributeValue("type", cty.StringVal(ipRange.Type))
+		body.SetAttributeValue("start_ip", cty.StringVal(startIP))
+		body.SetAttributeValue("end_ip", cty.StringVal(endIP))
+		if ipRange.Comment != "" {
+			body.SetAttributeValue("comment", cty.StringVal(ipRange.Comment))
+		}
+	}
+	return nil
+}
+
+func (e *exporter) exportMachines() error {
+	machines, err := e.client.Machines.Get(&entity.MachinesParams{})
+	if err != nil {
+		return err
+	}
+	sort.Slice(machines, func(i, j int) bool { return machines[i].Hostname < machines[j].Hostname })
+	for _, machine := range machines {
+		// MAAS keeps machine hostnames unique, so they are not looked up
+		// again through the importer which lists all the machines.
+		body := e.addResource("maas_machine", machine.Hostname, machine.SystemID, machine.Hostname)
+		resourceName := e.refs["maas_machine"][machine.SystemID]
+		body.SetAttributeValue("power_type", cty.StringVal(machine.PowerType))
+		powerParameters, err := e.getMachinePowerParameters(machine, resourceName)
+		if err != nil {
+			return err
+		}
+		body.SetAttributeRaw("power_parameters", hclwrite.TokensForFunctionCall("jsonencode", hclwrite.TokensForObject(powerParameters)))
+		body.SetAttributeValue("pxe_mac_address", cty.StringVal(machine.BootInterface.MACAddress))
+		body.SetAttributeValue("architecture", cty.StringVal(machine.Architecture))
+		body.SetAttributeValue("hostname", cty.StringVal(machine.Hostname))
+		body.SetAttributeValue("domain", cty.StringVal(machine.Domain.Name))
+		body.SetAttributeValue("zone", cty.StringVal(machine.Zone.Name))
+		body.SetAttributeRaw("pool", e.reference("maas_resource_pool", fmt.Sprintf("%v", machine.Pool.ID), "name", cty.StringVal(machine.Pool.Name)))
+		if machine.MinHWEKernel != "" {
+			body.SetAttributeValue("min_hwe_kernel", cty.StringVal(machine.MinHWEKernel))
+		}
+	}
+	return nil
+}
+
+// exportBlockDevices exports the physical block devices of the machines. The
+// partitions are computed by the resource, so they are not exported.
+func (e *exporter) exportBlockDevices() error {
+	machines, err := e.client.Machines.Get(&entity.MachinesParams{})
+	if err != nil {
+		return err
+	}
+	sort.Slice(machines, func(i, j int) bool { return machines[i].Hostname < machines[j].Hostname })
+	for _, machine := range machines {
+		blockDevices, err := e.client.BlockDevices.Get(machine.SystemID)
+		if err != nil {
+			return err
+		}
+		sort.Slice(blockDevices, func(i, j int) bool { return blockDevices[i].Name < blockDevices[j].Name })
+		for _, blockDevice := range blockDevices {
+			if blockDevice.Type != "physical" {
+				continue
+			}
+			// Block device names are unique per machine, so they are not
+			// looked up again through the importer
+			id := fmt.Sprintf("%v", blockDevice.ID)
+			body := e.addResource("maas_block_device", fmt.Sprintf("%s_%s", machine.Hostname, blockDevice.Name), id, fmt.Sprintf("%s:%s", machine.Hostname, blockDevice.Name))
+			body.SetAttributeRaw("machine", e.reference("maas_machine", machine.SystemID, "id", cty.StringVal(machine.SystemID)))
+			body.SetAttributeValue("name", cty.StringVal(blockDevice.Name))
+			body.SetAttributeValue("size_gigabytes", cty.NumberIntVal(blockDevice.Size/(1024*1024*1024)))
+			body.SetAttributeValue("block_size", cty.NumberIntVal(int64(blockDevice.BlockSize)))
+			if blockDevice.Model != "" && blockDevice.Serial != "" {
+				body.SetAttributeValue("model", cty.StringVal(blockDevice.Model))
+				body.SetAttributeValue("serial", cty.StringVal(blockDevice.Serial))
+			} else {
+				body.SetAttributeValue("id_path", cty.StringVal(blockDevice.IDPath))
+			}
+			if len(blockDevice.Tags) > 0 {
+				tags := make([]cty.Value, len(blockDevice.Tags))
+				for i, tag := range blockDevice.Tags {
+					tags[i] = cty.StringVal(tag)
+				}
+				body.SetAttributeValue("tags", cty.SetVal(tags))
+			}
+		}
+	}
+	return nil
+}
+
+// getMachinePowerParameters returns the machine power parameters as HCL
+// object attributes. Secret parameters are replaced by sensitive variables.
+func (e *exporter) getMachinePowerParameters(machine entity.Machine, resourceName string) ([]hclwrite.ObjectAttrTokens, error) {
+	params, err := e.client.Machine.GetPowerParameters(machine.SystemID)
+	if err != nil {
+		return nil, err
+	}
+	secrets := map[string]bool{}
+	if powerType, err := getPowerType(e.client, machine.PowerType); err == nil {
+		for _, field := range powerType.Fields {
+			secrets[field.Name] = field.Secret
+		}
+	}
+	names := make([]string, 0, len(params))
+	for k := range params {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	attrs := []hclwrite.ObjectAttrTokens{}
+	for _, k := range names {
+		if params[k] == nil || params[k] == "" {
+			continue
+		}
+		var value hclwrite.Tokens
+		if secrets[k] {
+			value = e.sensitiveVariable(fmt.Sprintf("%s_%s", resourceName, k), fmt.Sprintf("The %s power parameter of the %s machine.", k, machine.Hostname))
+		} else {
+			v, err := goToCtyValue(params[k])
+			if err != nil {
+				return nil, err
+			}
+			value = hclwrite.TokensForValue(v)
+		}
+		attrs = append(attrs, hclwrite.ObjectAttrTokens{
+			Name:  hclwrite.TokensForIdentifier(k),
+			Value: value,
+		})
+	}
+	return attrs, nil
+}
+
+func (e *exporter) exportTags() error {
+	tags, err := e.client.Tags.Get()
+	if err != nil {
+		return err
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	for _, tag := range tags {
+		body := e.addResource("maas_tag", tag.Name, tag.Name, tag.Name)
+		body.SetAttributeValue("name", cty.StringVal(tag.Name))
+		if tag.Comment != "" {
+			body.SetAttributeValue("comment", cty.StringVal(tag.Comment))
+		}
+		if tag.KernelOpts != "" {
+			body.SetAttributeValue("kernel_opts", cty.StringVal(tag.KernelOpts))
+		}
+		// Machines are tagged automatically by MAAS when a definition is set
+		if tag.Definition != "" {
+			body.SetAttributeValue("definition", cty.StringVal(tag.Definition))
+			continue
+		}
+		machines, err := e.client.Tag.GetMachines(tag.Name)
+		if err != nil {
+			return err
+		}
+		if len(machines) == 0 {
+			continue
+		}
+		sort.Slice(machines, func(i, j int) bool { return machines[i].Hostname < machines[j].Hostname })
+		machineRefs := make([]hclwrite.Tokens, len(machines))
+		for i, machine := range machines {
+			machineRefs[i] = e.reference("maas_machine", machine.SystemID, "id", cty.StringVal(machine.SystemID))
+		}
+		body.SetAttributeRaw("machines", hclwrite.TokensForTuple(machineRefs))
+	}
+	return nil
+}
+
+func (e *exporter) exportVMHosts() error {
+	vmHosts, err := e.client.VMHosts.Get()
+	if err != nil {
+		return err
+	}
+	index := exportIndex{}
+	for _, vmHost := range vmHosts {
+		index.add(fmt.Sprintf("%v", vmHost.ID), fmt.Sprintf("%v", vmHost.ID), vmHost.Name)
+	}
+	sort.Slice(vmHosts, func(i, j int) bool { return vmHosts[i].Name < vmHosts[j].Name })
+	for _, vmHost := range vmHosts {
+		id := fmt.Sprintf("%v", vmHost.ID)
+		body := e.addResource("maas_vm_host", vmHost.Name, id, importID(id, index, vmHost.Name, id))
+		resourceName := e.refs["maas_vm_host"][id]
+		body.SetAttributeValue("type", cty.StringVal(vmHost.Type))
+		if vmHost.Host.SystemID != "" {
+			body.SetAttributeRaw("machine", e.reference("maas_machine", vmHost.Host.SystemID, "id", cty.StringVal(vmHost.Host.SystemID)))
+		} else {
+			vmHostParams, err := e.client.VMHost.GetParameters(vmHost.ID)
+			if err != nil {
+				return err
+			}
+			for _, k := range []string{"power_address", "power_user"} {
+				if val := vmHostParams[k]; val != "" {
+					body.SetAttributeValue(k, cty.StringVal(val))
+				}
+			}
+			if vmHostParams["power_pass"] != "" {
+				body.SetAttributeRaw("power_pass", e.sensitiveVariable(fmt.Sprintf("%s_power_pass", resourceName), fmt.Sprintf("The power password of the %s VM host.", vmHost.Name)))
+			}
+		}
+		body.SetAttributeValue("name", cty.StringVal(vmHost.Name))
+		body.SetAttributeValue("zone", cty.StringVal(vmHost.Zone.Name))
+		body.SetAttributeRaw("pool", e.reference("maas_resource_pool", fmt.Sprintf("%v", vmHost.Pool.ID), "name", cty.StringVal(vmHost.Pool.Name)))
+		if len(vmHost.Tags) > 0 {
+			tags := make([]cty.Value, len(vmHost.Tags))
+			for i, tag := range vmHost.Tags {
+				tags[i] = cty.StringVal(tag)
+			}
+			body.SetAttributeValue("tags", cty.SetVal(tags))
+		}
+		body.SetAttributeValue("cpu_over_commit_ratio", cty.NumberFloatVal(vmHost.CPUOverCommitRatio))
+		body.SetAttributeValue("memory_over_commit_ratio", cty.NumberFloatVal(vmHost.MemoryOverCommitRatio))
+		if vmHost.DefaultMACVLANMode != "" {
+			body.SetAttributeValue("default_macvlan_mode", cty.StringVal(vmHost.DefaultMACVLANMode))
+		}
+	}
+	return nil
+}
+
+// exportDNSRecords exports the DNS records created in MAAS. The address
+// records generated by MAAS for the machines and devices are not listed.
+func (e *exporter) exportDNSRecords() error {
+	dnsResources, err := e.client.DNSResources.Get(&entity.DNSResourcesParams{})
+	if err != nil {
+		return err
+	}
+	index := exportIndex{}
+	for _, dnsResource := range dnsResources {
+		index.add(fmt.Sprintf("%v", dnsResource.ID), fmt.Sprintf("%v", dnsResource.ID), dnsResource.FQDN)
+	}
+	sort.Slice(dnsResources, func(i, j int) bool { return dnsResources[i].FQDN < dnsResources[j].FQDN })
+	for _, dnsResource := range dnsResources {
+		// Only the DNS resources with addresses are A/AAAA records, the other
+		// ones are exported from their resource records
+		if len(dnsResource.IPAddresses) == 0 {
+			continue
+		}
+		id := fmt.Sprintf("%v", dnsResource.ID)
+		body := e.addResource("maas_dns_record", fmt.Sprintf("a_%s", dnsResource.FQDN), id, "A/AAAA:"+importID(id, index, dnsResource.FQDN, id))
+		ips := make([]string, len(dnsResource.IPAddresses))
+		for i, ipAddress := range dnsResource.IPAddresses {
+			ips[i] = ipAddress.IP.String()
+		}
+		body.SetAttributeValue("type", cty.StringVal("A/AAAA"))
+		body.SetAttributeValue("fqdn", cty.StringVal(dnsResource.FQDN))
+		body.SetAttributeValue("data", cty.StringVal(strings.Join(ips, " ")))
+		if dnsResource.AddressTTL != 0 {
+			body.SetAttributeValue("ttl", cty.NumberIntVal(int64(dnsResource.AddressTTL)))
+		}
+	}
+
+	dnsResourceRecords, err := e.client.DNSResourceRecords.Get(&entity.DNSResourceRecordsParams{})
+	if err != nil {
+		return err
+	}
+	index = exportIndex{}
+	for _, dnsRecord := range dnsResourceRecords {
+		index.add(fmt.Sprintf("%v", dnsRecord.ID), fmt.Sprintf("%v", dnsRecord.ID), dnsRecord.FQDN)
+	}
+	sort.Slice(dnsResourceRecords, func(i, j int) bool { return dnsResourceRecords[i].ID < dnsResourceRecords[j].ID })
+	for _, dnsRecord := range dnsResourceRecords {
+		id := fmt.Sprintf("%v", dnsRecord.ID)
+		// The resource records are numbered apart from the DNS resources, so
+		// their references are prefixed to keep both kinds apart
+		body := e.addResource("maas_dns_record", fmt.Sprintf("%s_%s", dnsRecord.RRType, dnsRecord.FQDN), "rr:"+id, dnsRecord.RRType+":"+importID(id, index, dnsRecord.FQDN, id))
+		body.SetAttributeValue("type", cty.StringVal(dnsRecord.RRType))
+		body.SetAttributeValue("fqdn", cty.StringVal(dnsRecord.FQDN))
+		body.SetAttributeValue("data", cty.StringVal(dnsRecord.RRData))
+		if dnsRecord.TTL != 0 {
+			body.SetAttributeValue("ttl", cty.NumberIntVal(int64(dnsRecord.TTL)))
+		}
+	}
+	return nil
+}
+
+func getFabricsExportIndex(fabrics []entity.Fabric) exportIndex {
+	index := exportIndex{}
+	for _, fabric := range fabrics {
+		index.add(fmt.Sprintf("%v", fabric.ID), fmt.Sprintf("%v", fabric.ID), fabric.Name)
+	}
+	return index
+}
+
+func goToCtyValue(v interface{}) (cty.Value, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return cty.NilVal, err
+	}
+	t, err := ctyjson.ImpliedType(data)
+	if err != nil {
+		return cty.NilVal, err
+	}
+	return ctyjson.Unmarshal(data, t)
+}
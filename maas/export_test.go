@@ -0,0 +1,132 @@
+package maas
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/gomaasclient/client"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/stretchr/testify/assert"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func newTestExporter() *exporter {
+	return &exporter{
+		resources: map[string]*hclwrite.File{},
+		imports:   hclwrite.NewEmptyFile(),
+		variables: hclwrite.NewEmptyFile(),
+		names:     map[string]map[string]bool{},
+		refs:      map[string]map[string]string{},
+	}
+}
+
+func TestExporterResourceName(t *testing.T) {
+	e := newTestExporter()
+
+	assert.Equal(t, "machine_01", e.resourceName("maas_machine", "Machine.01"))
+	assert.Equal(t, "machine_01_2", e.resourceName("maas_machine", "machine 01"))
+	assert.Equal(t, "_10_0_0_0_24", e.resourceName("maas_subnet", "10.0.0.0/24"))
+	assert.Equal(t, "machine-01", e.resourceName("maas_tag", "machine-01."))
+}
+
+func TestExporterWrite(t *testing.T) {
+	e := newTestExporter()
+
+	fabric := e.addResource("maas_fabric", "fabric-0", "1", "fabric-0")
+	fabric.SetAttributeValue("name", cty.StringVal("fabric-0"))
+	vlan := e.addResource("maas_vlan", "fabric-0 untagged", "5001", "fabric-0:0")
+	vlan.SetAttributeRaw("fabric", e.reference("maas_fabric", "1", "id", cty.NumberIntVal(1)))
+	vlan.SetAttributeRaw("space", e.reference("maas_space", "2", "name", cty.StringVal("space-0")))
+
+	outputDir := t.TempDir()
+	assert.NoError(t, e.write(outputDir))
+
+	vlanConfig, err := os.ReadFile(filepath.Join(outputDir, "maas_vlan.tf"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(vlanConfig), "fabric = maas_fabric.fabric-0.id")
+	assert.Contains(t, string(vlanConfig), `space  = "space-0"`)
+
+	imports, err := os.ReadFile(filepath.Join(outputDir, "imports.tf"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(imports), "to = maas_vlan.fabric-0_untagged")
+	assert.Contains(t, string(imports), `id = "fabric-0:0"`)
+
+	// Existing files are never overwritten
+	assert.Error(t, e.write(outputDir))
+}
+
+func TestImportID(t *testing.T) {
+	// The pool named "1" cannot be imported by name, the importer resolves
+	// "1" to the pool with this ID, listed first
+	index := exportIndex{}
+	index.add("1", "1", "default")
+	index.add("2", "2", "1")
+	index.add("3", "3", "default")
+
+	assert.Equal(t, "default", importID("1", index, "default", "1"))
+	assert.Equal(t, "2", importID("2", index, "1", "2"))
+	assert.Equal(t, "3", importID("3", index, "default", "3"))
+}
+
+func TestExporterExportMachines(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/2.0/machines/" && r.URL.Query().Get("op") == "describe_power_types":
+			fmt.Fprint(w, `[{"name": "ipmi", "fields": [{"name": "power_address"}, {"name": "power_user"}, {"name": "power_pass", "secret": true}]}]`)
+		case r.URL.Path == "/api/2.0/machines/":
+			fmt.Fprint(w, `[{
+				"system_id": "abc123",
+				"hostname": "machine-01",
+				"power_type": "ipmi",
+				"architecture": "amd64/generic",
+				"boot_interface": {"mac_address": "00:00:00:00:00:01"},
+				"domain": {"name": "maas"},
+				"zone": {"name": "default"},
+				"pool": {"id": 1, "name": "default"}
+			}]`)
+		case r.URL.Path == "/api/2.0/machines/abc123/" && r.URL.Query().Get("op") == "power_parameters":
+			fmt.Fprint(w, `{"power_address": "10.0.0.1", "power_user": "admin", "power_pass": "secret", "power_boot_type": ""}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	c, err := client.GetClient(server.URL, "consumer:token:secret", "2.0")
+	assert.NoError(t, err)
+	outputDir := t.TempDir()
+	assert.NoError(t, Export(c, []string{"maas_machine"}, outputDir))
+
+	machines, err := os.ReadFile(filepath.Join(outputDir, "maas_machine.tf"))
+	assert.NoError(t, err)
+	assert.Equal(t, `resource "maas_machine" "machine-01" {
+  power_type = "ipmi"
+  power_parameters = jsonencode({
+    power_address = "10.0.0.1"
+    power_pass    = var.machine-01_power_pass
+    power_user    = "admin"
+  })
+  pxe_mac_address = "00:00:00:00:00:01"
+  architecture    = "amd64/generic"
+  hostname        = "machine-01"
+  domain          = "maas"
+  zone            = "default"
+  pool            = "default"
+}
+`, string(machines))
+	assert.NotContains(t, string(machines), "secret")
+
+	variables, err := os.ReadFile(filepath.Join(outputDir, "variables.tf"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(variables), `variable "machine-01_power_pass" {`)
+	assert.Contains(t, string(variables), "sensitive   = true")
+
+	imports, err := os.ReadFile(filepath.Join(outputDir, "imports.tf"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(imports), "to = maas_machine.machine-01")
+	assert.Contains(t, string(imports), `id = "machine-01"`)
+}
@@ -0,0 +1,584 @@
+package maas
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/gomaasclient/client"
+	"github.com/canonical/gomaasclient/entity"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+)
+
+const (
+	instanceNetworkInterfacePhysical = "physical"
+	instanceNetworkInterfaceBond     = "bond"
+	instanceNetworkInterfaceBridge   = "bridge"
+	instanceNetworkInterfaceVLAN     = "vlan"
+)
+
+// getInstanceNetworkInterfaceResource returns the schema of the
+// `maas_instance.network_interfaces` blocks.
+func getInstanceNetworkInterfaceResource() *schema.Resource {
+	return &schema.Resource{
+		Schema: map[string]*schema.Schema{
+			"bond": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				ForceNew:    true,
+				MaxItems:    1,
+				Description: "Creates a bond interface, named `name`, from the given parents. Only one of `bond`, `bridge` and `vlan` can be set. Defined below.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"bond_downdelay": {
+							Type:        schema.TypeInt,
+							Optional:    true,
+							ForceNew:    true,
+							Description: "The time, in milliseconds, to wait before disabling a parent after a link failure has been detected.",
+						},
+						"bond_lacp_rate": {
+							Type:             schema.TypeString,
+							Optional:         true,
+							ForceNew:         true,
+							ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice([]string{"fast", "slow"}, false)),
+							Description:      "The rate at which the link partner is asked to transmit LACPDU packets in `802.3ad` mode. Valid options are `fast` and `slow`.",
+						},
+						"bond_miimon": {
+							Type:        schema.TypeInt,
+							Optional:    true,
+							ForceNew:    true,
+							Description: "The link monitoring frequency, in milliseconds.",
+						},
+						"bond_mode": {
+							Type:             schema.TypeString,
+							Optional:         true,
+							ForceNew:         true,
+							ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice([]string{"balance-rr", "active-backup", "balance-xor", "broadcast", "802.3ad", "balance-tlb", "balance-alb"}, false)),
+							Description:      "The operating mode of the bond. Valid options are `balance-rr`, `active-backup`, `balance-xor`, `broadcast`, `802.3ad`, `balance-tlb` and `balance-alb`. MAAS defaults to `active-backup`.",
+						},
+						"bond_updelay": {
+							Type:        schema.TypeInt,
+							Optional:    true,
+							ForceNew:    true,
+							Description: "The time, in milliseconds, to wait before enabling a parent after a link recovery has been detected.",
+						},
+						"bond_xmit_hash_policy": {
+							Type:             schema.TypeString,
+							Optional:         true,
+							ForceNew:         true,
+							ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice([]string{"layer2", "layer2+3", "layer3+4", "encap2+3", "encap3+4"}, false)),
+							Description:      "The transmit hash policy used in the `balance-xor`, `802.3ad` and `balance-tlb` modes. Valid options are `layer2`, `layer2+3`, `layer3+4`, `encap2+3` and `encap3+4`.",
+						},
+						"mtu": {
+							Type:        schema.TypeInt,
+							Optional:    true,
+							ForceNew:    true,
+							Description: "The MTU of the bond interface.",
+						},
+						"parents": {
+							Type:        schema.TypeList,
+							Required:    true,
+							ForceNew:    true,
+							MinItems:    1,
+							Description: "The names, or `allocate_params.interfaces` labels, of the physical interfaces bonded together.",
+							Elem: &schema.Schema{
+								Type: schema.TypeString,
+							},
+						},
+					},
+				},
+			},
+			"bridge": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				ForceNew:    true,
+				MaxItems:    1,
+				Description: "Creates a bridge interface, named `name`, on the given parent. Only one of `bond`, `bridge` and `vlan` can be set. Defined below.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"bridge_fd": {
+							Type:        schema.TypeInt,
+							Optional:    true,
+							ForceNew:    true,
+							Description: "The bridge forward delay, in seconds.",
+						},
+						"bridge_stp": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							ForceNew:    true,
+							Description: "Turn the spanning tree protocol on. Defaults to `false`.",
+						},
+						"bridge_type": {
+							Type:             schema.TypeString,
+							Optional:         true,
+							ForceNew:         true,
+							ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice([]string{"standard", "ovs"}, false)),
+							Description:      "The type of the bridge. Valid options are `standard` and `ovs`.",
+						},
+						"mtu": {
+							Type:        schema.TypeInt,
+							Optional:    true,
+							ForceNew:    true,
+							Description: "The MTU of the bridge interface.",
+						},
+						"parent": {
+							Type:        schema.TypeString,
+							Required:    true,
+							ForceNew:    true,
+							Description: "The name, or `allocate_params.interfaces` label, of the bridged interface. It can be a bond or a VLAN defined by another `network_interfaces` block.",
+						},
+					},
+				},
+			},
+			"default_gateway": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				ForceNew:    true,
+				Default:     false,
+				Description: "Use the gateway of `subnet_cidr` as the default gateway of the machine. Only one network interface can set it, with the `AUTO` or `STATIC` modes. Defaults to `false`.",
+			},
+			"ip_address": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				ForceNew:         true,
+				ValidateDiagFunc: validation.ToDiagFunc(validation.IsIPAddress),
+				Description:      "Static IP address to be configured on the network interface. If this is set, the `subnet_cidr` is required.\n\n**NOTE:** If both `subnet_cidr` and `ip_address` are not defined, the interface will not be configured on the allocated machine.",
+			},
+			"label": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "The label of an `allocate_params.interfaces` constraint. The physical network interface matching the label is configured on the allocated machine. Exactly one of `name` and `label` must be set on physical interfaces.",
+			},
+			"mode": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				ForceNew:         true,
+				ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice([]string{"AUTO", "DHCP", "STATIC", "LINK_UP"}, false)),
+				Description:      "The link mode of the network interface. Valid options are:\n\t* `AUTO` - Random static IP address from `subnet_cidr`.\n\t* `DHCP` - IP address from the DHCP on the VLAN of the interface.\n\t* `STATIC` - Use `ip_address` as static IP address.\n\t* `LINK_UP` - Bring the interface up, without IP address.\n\nIt defaults to `STATIC` when `ip_address` is set, and to `AUTO` when only `subnet_cidr` is set.",
+			},
+			"name": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "The name of the network interface to be configured on the allocated machine. It's required for bonds and bridges, and VLANs default to `<parent>.<vid>`. Exactly one of `name` and `label` must be set on physical interfaces.",
+			},
+			"subnet_cidr": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "An existing subnet CIDR used to configure the network interface. Unless `ip_address` is defined, a free IP address is allocated from the subnet. It cannot be set on the parents of bonds and bridges, the same applies to `ip_address` and `mode`.",
+			},
+			"vlan": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				ForceNew:    true,
+				MaxItems:    1,
+				Description: "Creates a VLAN interface on the given parent. Only one of `bond`, `bridge` and `vlan` can be set. Defined below.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"mtu": {
+							Type:        schema.TypeInt,
+							Optional:    true,
+							ForceNew:    true,
+							Description: "The MTU of the VLAN interface.",
+						},
+						"parent": {
+							Type:        schema.TypeString,
+							Required:    true,
+							ForceNew:    true,
+							Description: "The name, or `allocate_params.interfaces` label, of the tagged interface. It can be a bond defined by another `network_interfaces` block.",
+						},
+						"vid": {
+							Type:             schema.TypeInt,
+							Required:         true,
+							ForceNew:         true,
+							ValidateDiagFunc: validation.ToDiagFunc(validation.IntBetween(1, 4094)),
+							Description:      "The VLAN ID, on the fabric of the parent interface.",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// getInstanceNetworkInterfaceKind returns whether the network interface is a
+// physical one, or a bond, bridge or VLAN created by the provider.
+func getInstanceNetworkInterfaceKind(n map[string]interface{}) string {
+	for _, kind := range []string{instanceNetworkInterfaceBond, instanceNetworkInterfaceBridge, instanceNetworkInterfaceVLAN} {
+		if getInstanceNetworkInterfaceBlock(n, kind) != nil {
+			return kind
+		}
+	}
+	return instanceNetworkInterfacePhysical
+}
+
+func getInstanceNetworkInterfaceBlock(n map[string]interface{}, kind string) map[string]interface{} {
+	if p, ok := n[kind].([]interface{}); ok && len(p) > 0 && p[0] != nil {
+		return p[0].(map[string]interface{})
+	}
+	return nil
+}
+
+func getInstanceNetworkInterfaceParents(n map[string]interface{}) []string {
+	switch kind := getInstanceNetworkInterfaceKind(n); kind {
+	case instanceNetworkInterfaceBond:
+		return convertToStringSlice(getInstanceNetworkInterfaceBlock(n, kind)["parents"])
+	case instanceNetworkInterfaceBridge, instanceNetworkInterfaceVLAN:
+		return []string{getInstanceNetworkInterfaceBlock(n, kind)["parent"].(string)}
+	}
+	return nil
+}
+
+// getInstanceNetworkInterfaceName returns the name of the network interface,
+// or its label. The VLAN interfaces are named `<parent>.<vid>` by default,
+// the name is used both to sort and to create them.
+func getInstanceNetworkInterfaceName(n map[string]interface{}) string {
+	if name := n["name"].(string); name != "" {
+		return name
+	}
+	if vlan := getInstanceNetworkInterfaceBlock(n, instanceNetworkInterfaceVLAN); vlan != nil {
+		return fmt.Sprintf("%s.%d", vlan["parent"], vlan["vid"])
+	}
+	return n["label"].(string)
+}
+
+// getInstanceNetworkInterfaceLinkMode returns the link mode of the network
+// interface, or an empty string if it's left disconnected.
+func getInstanceNetworkInterfaceLinkMode(n map[string]interface{}) string {
+	if mode := n["mode"].(string); mode != "" {
+		return mode
+	}
+	if n["subnet_cidr"].(string) == "" {
+		return ""
+	}
+	if n["ip_address"].(string) != "" {
+		return "STATIC"
+	}
+	return "AUTO"
+}
+
+// resolveInstanceNetworkInterfaceLabels returns the network interfaces with
+// the parents given by label replaced by the name of the matched interface.
+func resolveInstanceNetworkInterfaceLabels(networkInterfaces []map[string]interface{}, labels map[string]string) []map[string]interface{} {
+	resolve := func(parent string) string {
+		if name, ok := labels[parent]; ok {
+			return name
+		}
+		return parent
+	}
+
+	resolved := make([]map[string]interface{}, len(networkInterfaces))
+	for i, n := range networkInterfaces {
+		kind := getInstanceNetworkInterfaceKind(n)
+		if kind == instanceNetworkInterfacePhysical {
+			resolved[i] = n
+			continue
+		}
+		block := map[string]interface{}{}
+		for k, v := range getInstanceNetworkInterfaceBlock(n, kind) {
+			block[k] = v
+		}
+		if kind == instanceNetworkInterfaceBond {
+			parents := []interface{}{}
+			for _, parent := range getInstanceNetworkInterfaceParents(n) {
+				parents = append(parents, resolve(parent))
+			}
+			block["parents"] = parents
+		} else {
+			block["parent"] = resolve(block["parent"].(string))
+		}
+		resolved[i] = map[string]interface{}{}
+		for k, v := range n {
+			resolved[i][k] = v
+		}
+		resolved[i][kind] = []interface{}{block}
+	}
+	return resolved
+}
+
+// sortInstanceNetworkInterfaces returns the network interfaces in the order
+// they must be created: the physical interfaces first, then the bonds, bridges
+// and VLANs after their parents.
+func sortInstanceNetworkInterfaces(networkInterfaces []map[string]interface{}) ([]map[string]interface{}, error) {
+	var sorted, pending []map[string]interface{}
+	pendingNames := map[string]bool{}
+	for _, n := range networkInterfaces {
+		if getInstanceNetworkInterfaceKind(n) == instanceNetworkInterfacePhysical {
+			sorted = append(sorted, n)
+			continue
+		}
+		pending = append(pending, n)
+		pendingNames[getInstanceNetworkInterfaceName(n)] = true
+	}
+
+	for len(pending) > 0 {
+		var next []map[string]interface{}
+		for _, n := range pending {
+			ready := true
+			for _, parent := range getInstanceNetworkInterfaceParents(n) {
+				if pendingNames[parent] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				sorted = append(sorted, n)
+				delete(pendingNames, getInstanceNetworkInterfaceName(n))
+			} else {
+				next = append(next, n)
+			}
+		}
+		if len(next) == len(pending) {
+			names := make([]string, len(next))
+			for i, n := range next {
+				names[i] = getInstanceNetworkInterfaceName(n)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("network_interfaces: the parents of (%s) depend on each other", strings.Join(names, ", "))
+		}
+		pending = next
+	}
+
+	return sorted, nil
+}
+
+// validateInstanceNetworkInterfaces checks the `network_interfaces` blocks
+// before the machine is allocated.
+func validateInstanceNetworkInterfaces(networkInterfaces []interface{}) error {
+	var configs []map[string]interface{}
+	var defaultGateways []string
+	for _, networkInterface := range networkInterfaces {
+		n := networkInterface.(map[string]interface{})
+		configs = append(configs, n)
+
+		kinds := 0
+		for _, kind := range []string{instanceNetworkInterfaceBond, instanceNetworkInterfaceBridge, instanceNetworkInterfaceVLAN} {
+			if getInstanceNetworkInterfaceBlock(n, kind) != nil {
+				kinds++
+			}
+		}
+		if kinds > 1 {
+			return fmt.Errorf("network_interfaces: only one of 'bond', 'bridge' and 'vlan' can be set")
+		}
+
+		name := getInstanceNetworkInterfaceName(n)
+		switch kind := getInstanceNetworkInterfaceKind(n); kind {
+		case instanceNetworkInterfacePhysical:
+			if (n["name"].(string) == "") == (n["label"].(string) == "") {
+				return fmt.Errorf("network_interfaces: exactly one of 'name' and 'label' must be set")
+			}
+		default:
+			if n["label"].(string) != "" {
+				return fmt.Errorf("network_interfaces: 'label' cannot be set on the %s interfaces, use 'name'", kind)
+			}
+			if kind != instanceNetworkInterfaceVLAN && n["name"].(string) == "" {
+				return fmt.Errorf("network_interfaces: 'name' is required on the %s interfaces", kind)
+			}
+		}
+
+		mode := getInstanceNetworkInterfaceLinkMode(n)
+		subnetCIDR := n["subnet_cidr"].(string)
+		ipAddress := n["ip_address"].(string)
+		switch {
+		case ipAddress != "" && subnetCIDR == "":
+			return fmt.Errorf("network interface (%s): 'subnet_cidr' is required when 'ip_address' is set", name)
+		case ipAddress != "" && mode != "STATIC":
+			return fmt.Errorf("network interface (%s): 'ip_address' can only be set with the STATIC mode", name)
+		case (mode == "AUTO" || mode == "STATIC") && subnetCIDR == "":
+			return fmt.Errorf("network interface (%s): 'subnet_cidr' is required with the %s mode", name, mode)
+		case mode == "STATIC" && ipAddress == "":
+			return fmt.Errorf("network interface (%s): 'ip_address' is required with the STATIC mode", name)
+		}
+		if n["default_gateway"].(bool) {
+			if mode != "AUTO" && mode != "STATIC" {
+				return fmt.Errorf("network interface (%s): 'default_gateway' can only be set with the AUTO and STATIC modes", name)
+			}
+			defaultGateways = append(defaultGateways, name)
+		}
+	}
+	if len(defaultGateways) > 1 {
+		sort.Strings(defaultGateways)
+		return fmt.Errorf("network_interfaces: only one network interface can set 'default_gateway', it's set on (%s)", strings.Join(defaultGateways, ", "))
+	}
+
+	// The parents of the bonds and bridges cannot be linked to a subnet
+	enslaved := map[string]string{}
+	for _, n := range configs {
+		if kind := getInstanceNetworkInterfaceKind(n); kind == instanceNetworkInterfaceBond || kind == instanceNetworkInterfaceBridge {
+			for _, parent := range getInstanceNetworkInterfaceParents(n) {
+				enslaved[parent] = kind
+			}
+		}
+	}
+	for _, n := range configs {
+		name := getInstanceNetworkInterfaceName(n)
+		kind, ok := enslaved[name]
+		if ok && (n["subnet_cidr"].(string) != "" || n["ip_address"].(string) != "" || n["mode"].(string) != "") {
+			return fmt.Errorf("network interface (%s): 'subnet_cidr', 'ip_address' and 'mode' cannot be set on the parent of a %s", name, kind)
+		}
+	}
+
+	_, err := sortInstanceNetworkInterfaces(configs)
+	return err
+}
+
+// configureInstanceNetworkInterfaces creates the bonds, bridges and VLANs of
+// the allocated machine, in dependency order, then links the network
+// interfaces to their subnets.
+func configureInstanceNetworkInterfaces(client *client.Client, d *schema.ResourceData, machine *entity.Machine, interfaceConstraints map[string][]interface{}) error {
+	var configs []map[string]interface{}
+	for _, networkInterface := range d.Get("network_interfaces").(*schema.Set).List() {
+		configs = append(configs, networkInterface.(map[string]interface{}))
+	}
+
+	// Refer to the parents matched by label with their name, so the VLAN
+	// interfaces are sorted and created with the same name
+	labels := map[string]string{}
+	names := getMachineNetworkInterfaceNames(machine)
+	for label, ids := range interfaceConstraints {
+		if len(ids) == 0 {
+			continue
+		}
+		if name, ok := names[fmt.Sprint(ids[0])]; ok {
+			labels[label] = name
+		}
+	}
+	configs, err := sortInstanceNetworkInterfaces(resolveInstanceNetworkInterfaceLabels(configs, labels))
+	if err != nil {
+		return err
+	}
+
+	// Find the machine network interfaces by name, or by allocation label
+	getNIC := func(identifier string) (*entity.NetworkInterface, error) {
+		name := identifier
+		if ids, ok := interfaceConstraints[identifier]; ok && len(ids) > 0 {
+			if name, ok = getMachineNetworkInterfaceNames(machine)[fmt.Sprint(ids[0])]; !ok {
+				return nil, fmt.Errorf("network interface (%v) matched by label (%s) not found", ids[0], identifier)
+			}
+		}
+		return getNetworkInterface(client, machine.SystemID, name)
+	}
+
+	nics := make([]*entity.NetworkInterface, len(configs))
+	for i, n := range configs {
+		if label := n["label"].(string); label != "" && len(interfaceConstraints[label]) == 0 {
+			return fmt.Errorf("network interface label (%s) was not matched by the allocation, it must be defined in 'allocate_params.interfaces'", label)
+		}
+		if nics[i], err = createInstanceNetworkInterface(client, machine.SystemID, n, getNIC); err != nil {
+			return err
+		}
+	}
+	for i, n := range configs {
+		if err := linkInstanceNetworkInterface(client, machine.SystemID, nics[i], n); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createInstanceNetworkInterface creates the given bond, bridge or VLAN
+// interface, or returns the given physical interface.
+func createInstanceNetworkInterface(client *client.Client, machineSystemID string, n map[string]interface{}, getNIC func(string) (*entity.NetworkInterface, error)) (*entity.NetworkInterface, error) {
+	kind := getInstanceNetworkInterfaceKind(n)
+	if kind == instanceNetworkInterfacePhysical {
+		return getNIC(getInstanceNetworkInterfaceName(n))
+	}
+
+	var parents []*entity.NetworkInterface
+	for _, parent := range getInstanceNetworkInterfaceParents(n) {
+		nic, err := getNIC(parent)
+		if err != nil {
+			return nil, err
+		}
+		parents = append(parents, nic)
+	}
+	parentIDs := make([]int, len(parents))
+	for i, parent := range parents {
+		parentIDs[i] = parent.ID
+		// Clear the links of the bonded and bridged interfaces
+		if kind != instanceNetworkInterfaceVLAN && parent.Type != "vlan" {
+			if _, err := client.NetworkInterface.Disconnect(machineSystemID, parent.ID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	config := getInstanceNetworkInterfaceBlock(n, kind)
+	switch kind {
+	case instanceNetworkInterfaceBond:
+		d := newInstanceNetworkInterfaceConfig(resourceMaasNetworkInterfaceBond(), n, config)
+		return client.NetworkInterfaces.CreateBond(machineSystemID, getNetworkInterfaceBondParams(d, parentIDs))
+	case instanceNetworkInterfaceBridge:
+		d := newInstanceNetworkInterfaceConfig(resourceMaasNetworkInterfaceBridge(), n, config)
+		return client.NetworkInterfaces.CreateBridge(machineSystemID, getNetworkInterfaceBridgeParams(d, parentIDs[0]))
+	default:
+		// The VLAN is looked up on the fabric of the parent interface
+		vlan, err := getVlan(client, parents[0].VLAN.FabricID, strconv.Itoa(config["vid"].(int)))
+		if err != nil {
+			return nil, err
+		}
+		d := newInstanceNetworkInterfaceConfig(resourceMaasNetworkInterfaceVlan(), n, config)
+		params := getNetworkInterfaceVlanParams(d, parentIDs[0], vlan.ID)
+		params.Name = getInstanceNetworkInterfaceName(n)
+		return client.NetworkInterfaces.CreateVLAN(machineSystemID, params)
+	}
+}
+
+// instanceNetworkInterfaceConfig reads the settings of an inline bond, bridge
+// or VLAN interface with the schema of the matching network interface
+// resource, so the parameters are built the same way. The arguments which
+// cannot be set inline read as their zero value.
+type instanceNetworkInterfaceConfig struct {
+	schema map[string]*schema.Schema
+	values map[string]interface{}
+}
+
+func newInstanceNetworkInterfaceConfig(resource *schema.Resource, n map[string]interface{}, config map[string]interface{}) *instanceNetworkInterfaceConfig {
+	values := map[string]interface{}{"name": n["name"]}
+	for k, v := range config {
+		values[k] = v
+	}
+	return &instanceNetworkInterfaceConfig{schema: resource.Schema, values: values}
+}
+
+func (c *instanceNetworkInterfaceConfig) Get(key string) interface{} {
+	if v, ok := c.values[key]; ok {
+		return v
+	}
+	return c.schema[key].ZeroValue()
+}
+
+// linkInstanceNetworkInterface replaces the links of the network interface
+// with the configured one. Without link mode, the network interface is left
+// disconnected.
+func linkInstanceNetworkInterface(client *client.Client, machineSystemID string, nic *entity.NetworkInterface, n map[string]interface{}) error {
+	mode := getInstanceNetworkInterfaceLinkMode(n)
+	if mode == "" {
+		// VLAN interfaces cannot be disconnected, and have no links once created
+		if nic.Type == "vlan" {
+			return nil
+		}
+		_, err := client.NetworkInterface.Disconnect(machineSystemID, nic.ID)
+		return err
+	}
+
+	params := &entity.NetworkInterfaceLinkParams{
+		Mode:           mode,
+		IPAddress:      n["ip_address"].(string),
+		DefaultGateway: n["default_gateway"].(bool),
+	}
+	if subnetCIDR := n["subnet_cidr"].(string); subnetCIDR != "" {
+		subnet, err := getSubnet(client, subnetCIDR)
+		if err != nil {
+			return err
+		}
+		params.Subnet = subnet.ID
+	}
+	_, err := createNetworkInterfaceLink(client, machineSystemID, nic, params)
+	return err
+}
@@ -0,0 +1,204 @@
+package maas
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestInstanceNetworkInterfaces(t *testing.T, networkInterfaces ...map[string]interface{}) []interface{} {
+	raw := make([]interface{}, len(networkInterfaces))
+	for i, n := range networkInterfaces {
+		raw[i] = n
+	}
+	d := schema.TestResourceDataRaw(t, resourceMaasInstance().Schema, map[string]interface{}{"network_interfaces": raw})
+	return d.Get("network_interfaces").(*schema.Set).List()
+}
+
+func TestSortInstanceNetworkInterfaces(t *testing.T) {
+	networkInterfaces := getTestInstanceNetworkInterfaces(t,
+		map[string]interface{}{"name": "br0", "bridge": []interface{}{map[string]interface{}{"parent": "bond0.100"}}},
+		map[string]interface{}{"vlan": []interface{}{map[string]interface{}{"parent": "bond0", "vid": 100}}},
+		map[string]interface{}{"name": "bond0", "bond": []interface{}{map[string]interface{}{"parents": []interface{}{"eth0", "eth_data"}}}},
+		map[string]interface{}{"label": "eth_data"},
+	)
+	configs := make([]map[string]interface{}, len(networkInterfaces))
+	for i, n := range networkInterfaces {
+		configs[i] = n.(map[string]interface{})
+	}
+
+	sorted, err := sortInstanceNetworkInterfaces(configs)
+	assert.NoError(t, err)
+	names := make([]string, len(sorted))
+	for i, n := range sorted {
+		names[i] = getInstanceNetworkInterfaceName(n)
+	}
+	assert.Equal(t, []string{"eth_data", "bond0", "bond0.100", "br0"}, names)
+}
+
+func TestSortInstanceNetworkInterfacesByLabel(t *testing.T) {
+	// The VLAN parent is given by label, the bridge refers to the VLAN with
+	// the actual name of the matched interface
+	networkInterfaces := getTestInstanceNetworkInterfaces(t,
+		map[string]interface{}{"name": "br0", "bridge": []interface{}{map[string]interface{}{"parent": "eth2.100"}}},
+		map[string]interface{}{"vlan": []interface{}{map[string]interface{}{"parent": "eth_data", "vid": 100}}},
+		map[string]interface{}{"label": "eth_data"},
+	)
+	configs := make([]map[string]interface{}, len(networkInterfaces))
+	for i, n := range networkInterfaces {
+		configs[i] = n.(map[string]interface{})
+	}
+
+	sorted, err := sortInstanceNetworkInterfaces(resolveInstanceNetworkInterfaceLabels(configs, map[string]string{"eth_data": "eth2"}))
+	assert.NoError(t, err)
+	names := make([]string, len(sorted))
+	for i, n := range sorted {
+		names[i] = getInstanceNetworkInterfaceName(n)
+	}
+	assert.Equal(t, []string{"eth_data", "eth2.100", "br0"}, names)
+
+	// The configuration is left unchanged
+	for _, n := range configs {
+		if vlan := getInstanceNetworkInterfaceBlock(n, instanceNetworkInterfaceVLAN); vlan != nil {
+			assert.Equal(t, "eth_data", vlan["parent"])
+		}
+	}
+}
+
+func TestInstanceNetworkInterfaceParams(t *testing.T) {
+	networkInterfaces := getTestInstanceNetworkInterfaces(t,
+		map[string]interface{}{"name": "bond0", "bond": []interface{}{map[string]interface{}{"parents": []interface{}{"eth0", "eth1"}, "bond_mode": "802.3ad", "mtu": 9000}}},
+		map[string]interface{}{"name": "br0", "bridge": []interface{}{map[string]interface{}{"parent": "bond0", "bridge_stp": true}}},
+	)
+	var bond, bridge map[string]interface{}
+	for _, n := range networkInterfaces {
+		if n := n.(map[string]interface{}); n["name"] == "bond0" {
+			bond = n
+		} else {
+			bridge = n
+		}
+	}
+
+	d := newInstanceNetworkInterfaceConfig(resourceMaasNetworkInterfaceBond(), bond, getInstanceNetworkInterfaceBlock(bond, instanceNetworkInterfaceBond))
+	bondParams := getNetworkInterfaceBondParams(d, []int{1, 2})
+	assert.Equal(t, "bond0", bondParams.Name)
+	assert.Equal(t, []int{1, 2}, bondParams.Parents)
+	assert.Equal(t, "802.3ad", bondParams.BondMode)
+	assert.Equal(t, 9000, bondParams.MTU)
+	assert.Equal(t, "", bondParams.Tags)
+
+	d = newInstanceNetworkInterfaceConfig(resourceMaasNetworkInterfaceBridge(), bridge, getInstanceNetworkInterfaceBlock(bridge, instanceNetworkInterfaceBridge))
+	bridgeParams := getNetworkInterfaceBridgeParams(d, 3)
+	assert.Equal(t, "br0", bridgeParams.Name)
+	assert.Equal(t, []int{3}, bridgeParams.Parents)
+	assert.True(t, bridgeParams.BridgeSTP)
+	assert.Equal(t, 0, bridgeParams.VLAN)
+}
+
+func TestValidateInstanceNetworkInterfaces(t *testing.T) {
+	testCases := []struct {
+		name              string
+		networkInterfaces []map[string]interface{}
+		err               string
+	}{
+		{
+			name: "physical interfaces",
+			networkInterfaces: []map[string]interface{}{
+				{"name": "eth0", "subnet_cidr": "10.0.0.0/24", "ip_address": "10.0.0.10", "default_gateway": true},
+				{"label": "eth_data", "mode": "DHCP"},
+				{"name": "eth2"},
+			},
+		},
+		{
+			name: "bond, bridge and vlan",
+			networkInterfaces: []map[string]interface{}{
+				{"name": "bond0", "mode": "LINK_UP", "bond": []interface{}{map[string]interface{}{"parents": []interface{}{"eth0", "eth1"}, "bond_mode": "802.3ad"}}},
+				{"vlan": []interface{}{map[string]interface{}{"parent": "bond0", "vid": 100}}},
+				{"name": "br0", "subnet_cidr": "10.0.0.0/24", "default_gateway": true, "bridge": []interface{}{map[string]interface{}{"parent": "bond0.100"}}},
+			},
+		},
+		{
+			name:              "physical without name",
+			networkInterfaces: []map[string]interface{}{{"subnet_cidr": "10.0.0.0/24"}},
+			err:               "network_interfaces: exactly one of 'name' and 'label' must be set",
+		},
+		{
+			name:              "bond without name",
+			networkInterfaces: []map[string]interface{}{{"bond": []interface{}{map[string]interface{}{"parents": []interface{}{"eth0"}}}}},
+			err:               "network_interfaces: 'name' is required on the bond interfaces",
+		},
+		{
+			name:              "bridge with label",
+			networkInterfaces: []map[string]interface{}{{"name": "br0", "label": "eth_data", "bridge": []interface{}{map[string]interface{}{"parent": "eth0"}}}},
+			err:               "network_interfaces: 'label' cannot be set on the bridge interfaces, use 'name'",
+		},
+		{
+			name: "bond and bridge",
+			networkInterfaces: []map[string]interface{}{{
+				"name":   "br0",
+				"bond":   []interface{}{map[string]interface{}{"parents": []interface{}{"eth0"}}},
+				"bridge": []interface{}{map[string]interface{}{"parent": "eth0"}},
+			}},
+			err: "network_interfaces: only one of 'bond', 'bridge' and 'vlan' can be set",
+		},
+		{
+			name:              "static without ip address",
+			networkInterfaces: []map[string]interface{}{{"name": "eth0", "subnet_cidr": "10.0.0.0/24", "mode": "STATIC"}},
+			err:               "network interface (eth0): 'ip_address' is required with the STATIC mode",
+		},
+		{
+			name:              "ip address with dhcp",
+			networkInterfaces: []map[string]interface{}{{"name": "eth0", "subnet_cidr": "10.0.0.0/24", "ip_address": "10.0.0.10", "mode": "DHCP"}},
+			err:               "network interface (eth0): 'ip_address' can only be set with the STATIC mode",
+		},
+		{
+			name:              "default gateway with link up",
+			networkInterfaces: []map[string]interface{}{{"name": "eth0", "mode": "LINK_UP", "default_gateway": true}},
+			err:               "network interface (eth0): 'default_gateway' can only be set with the AUTO and STATIC modes",
+		},
+		{
+			name: "two default gateways",
+			networkInterfaces: []map[string]interface{}{
+				{"name": "eth0", "subnet_cidr": "10.0.0.0/24", "default_gateway": true},
+				{"name": "eth1", "subnet_cidr": "10.0.1.0/24", "default_gateway": true},
+			},
+			err: "network_interfaces: only one network interface can set 'default_gateway', it's set on (eth0, eth1)",
+		},
+		{
+			name: "bond parent with subnet",
+			networkInterfaces: []map[string]interface{}{
+				{"name": "eth0", "subnet_cidr": "10.0.0.0/24"},
+				{"name": "bond0", "subnet_cidr": "10.0.1.0/24", "bond": []interface{}{map[string]interface{}{"parents": []interface{}{"eth0", "eth1"}}}},
+			},
+			err: "network interface (eth0): 'subnet_cidr', 'ip_address' and 'mode' cannot be set on the parent of a bond",
+		},
+		{
+			name: "bridge parent with link up",
+			networkInterfaces: []map[string]interface{}{
+				{"label": "eth_data", "mode": "LINK_UP"},
+				{"name": "br0", "bridge": []interface{}{map[string]interface{}{"parent": "eth_data"}}},
+			},
+			err: "network interface (eth_data): 'subnet_cidr', 'ip_address' and 'mode' cannot be set on the parent of a bridge",
+		},
+		{
+			name: "parents cycle",
+			networkInterfaces: []map[string]interface{}{
+				{"name": "br0", "bridge": []interface{}{map[string]interface{}{"parent": "br1"}}},
+				{"name": "br1", "bridge": []interface{}{map[string]interface{}{"parent": "br0"}}},
+			},
+			err: "network_interfaces: the parents of (br0, br1) depend on each other",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := validateInstanceNetworkInterfaces(getTestInstanceNetworkInterfaces(t, testCase.networkInterfaces...))
+			if testCase.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, testCase.err)
+			}
+		})
+	}
+}
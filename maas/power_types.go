@@ -0,0 +1,447 @@
+package maas
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/canonical/gomaasclient/client"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+)
+
+// PowerType represents a power driver, as returned by the MAAS
+// `describe_power_types` API operation.
+type PowerType struct {
+	Name            string           `json:"name,omitempty"`
+	Description     string           `json:"description,omitempty"`
+	DriverType      string           `json:"driver_type,omitempty"`
+	Fields          []PowerTypeField `json:"fields,omitempty"`
+	MissingPackages []string         `json:"missing_packages,omitempty"`
+	Chassis         bool             `json:"chassis,omitempty"`
+	CanProbe        bool             `json:"can_probe,omitempty"`
+	Queryable       bool             `json:"queryable,omitempty"`
+}
+
+// PowerTypeField represents a parameter of a power driver.
+type PowerTypeField struct {
+	Name      string      `json:"name,omitempty"`
+	Label     string      `json:"label,omitempty"`
+	FieldType string      `json:"field_type,omitempty"`
+	Scope     string      `json:"scope,omitempty"`
+	Default   interface{} `json:"default,omitempty"`
+	Choices   [][]string  `json:"choices,omitempty"`
+	Required  bool        `json:"required,omitempty"`
+	Secret    bool        `json:"secret,omitempty"`
+}
+
+// powerTypesCache holds the power drivers of each configured MAAS client,
+// so they are fetched only once per Terraform run.
+var powerTypesCache = struct {
+	sync.Mutex
+	powerTypes map[*client.Client][]PowerType
+}{powerTypes: map[*client.Client][]PowerType{}}
+
+func getPowerTypes(client *client.Client) ([]PowerType, error) {
+	powerTypesCache.Lock()
+	defer powerTypesCache.Unlock()
+
+	if powerTypes, ok := powerTypesCache.powerTypes[client]; ok {
+		return powerTypes, nil
+	}
+	apiClient, err := getAPIClient(client)
+	if err != nil {
+		return nil, err
+	}
+	powerTypes := []PowerType{}
+	err = apiClient.GetSubObject("machines").Get("describe_power_types", url.Values{}, func(data []byte) error {
+		return json.Unmarshal(data, &powerTypes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	powerTypesCache.powerTypes[client] = powerTypes
+
+	return powerTypes, nil
+}
+
+func getPowerType(client *client.Client, name string) (*PowerType, error) {
+	powerTypes, err := getPowerTypes(client)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(powerTypes))
+	for i, powerType := range powerTypes {
+		if powerType.Name == name {
+			return &powerType, nil
+		}
+		names[i] = powerType.Name
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("power type (%s) is not supported by MAAS, expected one of: %s", name, strings.Join(names, ", "))
+}
+
+// validatePowerParameters checks the given power parameters against the
+// fields of the power driver: unknown parameters, missing required
+// parameters and values which are not in the field choices are rejected.
+func validatePowerParameters(powerType *PowerType, params map[string]interface{}) error {
+	fields := map[string]PowerTypeField{}
+	names := make([]string, len(powerType.Fields))
+	for i, field := range powerType.Fields {
+		fields[field.Name] = field
+		names[i] = field.Name
+	}
+	sort.Strings(names)
+
+	var errs []string
+	for k, v := range params {
+		field, ok := fields[k]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("unknown power parameter %q for power type %q, expected one of: %s", k, powerType.Name, strings.Join(names, ", ")))
+			continue
+		}
+		if len(field.Choices) == 0 {
+			continue
+		}
+		values := []interface{}{v}
+		if l, ok := v.([]interface{}); ok {
+			values = l
+		}
+		for _, value := range values {
+			if !isPowerTypeFieldChoice(field, fmt.Sprintf("%v", value)) {
+				errs = append(errs, fmt.Sprintf("invalid value %q for power parameter %q, expected one of: %s", value, k, strings.Join(getPowerTypeFieldChoices(field), ", ")))
+			}
+		}
+	}
+	for _, field := range powerType.Fields {
+		if !field.Required || field.Default != nil && field.Default != "" {
+			continue
+		}
+		if v, ok := params[field.Name]; !ok || v == "" {
+			errs = append(errs, fmt.Sprintf("power parameter %q is required for power type %q", field.Name, powerType.Name))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("invalid power parameters:\n%s", strings.Join(errs, "\n"))
+	}
+
+	return nil
+}
+
+func isPowerTypeFieldChoice(field PowerTypeField, value string) bool {
+	for _, choice := range getPowerTypeFieldChoices(field) {
+		if choice == value {
+			return true
+		}
+	}
+	return false
+}
+
+func getPowerTypeFieldChoices(field PowerTypeField) []string {
+	choices := make([]string, 0, len(field.Choices))
+	for _, choice := range field.Choices {
+		if len(choice) > 0 {
+			choices = append(choices, choice[0])
+		}
+	}
+	return choices
+}
+
+// powerTypeBlocks maps the typed power configuration blocks of the
+// `maas_machine` resource to their power type.
+var powerTypeBlocks = map[string]string{
+	"power_ipmi":    "ipmi",
+	"power_lxd":     "lxd",
+	"power_proxmox": "proxmox",
+	"power_redfish": "redfish",
+	"power_virsh":   "virsh",
+	"power_webhook": "webhook",
+}
+
+// getPowerParametersArguments returns the `maas_machine` arguments which
+// can hold the power parameters. Exactly one of them must be set.
+func getPowerParametersArguments() []string {
+	names := []string{"power_parameters"}
+	for name := range powerTypeBlocks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func powerTypeBlockSchema(powerType string, fields map[string]*schema.Schema) *schema.Schema {
+	return &schema.Schema{
+		Type:         schema.TypeList,
+		Optional:     true,
+		MaxItems:     1,
+		ExactlyOneOf: getPowerParametersArguments(),
+		Description:  fmt.Sprintf("Typed power parameters used when `power_type` is `%s`. Sensitive parameters are marked individually. Parameters defined below. This argument conflicts with `power_parameters`.", powerType),
+		Elem:         &schema.Resource{Schema: fields},
+	}
+}
+
+func powerTypeVerifySSLSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:             schema.TypeString,
+		Optional:         true,
+		ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice([]string{"y", "n"}, false)),
+		Description:      "Verify the SSL connections with the system's root CA certificates. Supported values are: `y`, `n`.",
+	}
+}
+
+func powerTypeIPMISchema() *schema.Schema {
+	return powerTypeBlockSchema("ipmi", map[string]*schema.Schema{
+		"cipher_suite_id": {
+			Type:             schema.TypeString,
+			Optional:         true,
+			ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice([]string{"17", "3", "8", "12"}, false)),
+			Description:      "The IPMI cipher suite ID. Supported values are: `17`, `3`, `8`, `12`.",
+		},
+		"k_g": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Sensitive:   true,
+			Description: "The IPMI K_g BMC key.",
+		},
+		"mac_address": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "The MAC address of the BMC.",
+		},
+		"power_address": {
+			Type:        schema.TypeString,
+			Required:    true,
+			Description: "The IP address of the BMC.",
+		},
+		"power_boot_type": {
+			Type:             schema.TypeString,
+			Optional:         true,
+			ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice([]string{"auto", "legacy", "efi"}, false)),
+			Description:      "The boot type. Supported values are: `auto`, `legacy`, `efi`.",
+		},
+		"power_driver": {
+			Type:             schema.TypeString,
+			Optional:         true,
+			ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice([]string{"LAN", "LAN_2_0"}, false)),
+			Description:      "The IPMI power driver. Supported values are: `LAN`, `LAN_2_0`.",
+		},
+		"power_pass": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Sensitive:   true,
+			Description: "The BMC password.",
+		},
+		"power_user": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "The BMC user name.",
+		},
+		"privilege_level": {
+			Type:             schema.TypeString,
+			Optional:         true,
+			ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice([]string{"USER", "OPERATOR", "ADMIN"}, false)),
+			Description:      "The IPMI privilege level. Supported values are: `USER`, `OPERATOR`, `ADMIN`.",
+		},
+		"workaround_flags": {
+			Type:        schema.TypeList,
+			Optional:    true,
+			Description: "A list of IPMI workaround flags (e.g. `opensesspriv`).",
+			Elem: &schema.Schema{
+				Type: schema.TypeString,
+			},
+		},
+	})
+}
+
+func powerTypeLXDSchema() *schema.Schema {
+	return powerTypeBlockSchema("lxd", map[string]*schema.Schema{
+		"certificate": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "The LXD client certificate.",
+		},
+		"instance_name": {
+			Type:        schema.TypeString,
+			Required:    true,
+			Description: "The LXD instance name.",
+		},
+		"key": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Sensitive:   true,
+			Description: "The LXD client private key.",
+		},
+		"password": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Sensitive:   true,
+			Description: "The LXD trust password.",
+		},
+		"power_address": {
+			Type:        schema.TypeString,
+			Required:    true,
+			Description: "The LXD address (e.g. `https://10.0.0.2:8443`).",
+		},
+		"project": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "The LXD project.",
+		},
+	})
+}
+
+func powerTypeProxmoxSchema() *schema.Schema {
+	return powerTypeBlockSchema("proxmox", map[string]*schema.Schema{
+		"power_address": {
+			Type:        schema.TypeString,
+			Required:    true,
+			Description: "The Proxmox host address.",
+		},
+		"power_pass": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Sensitive:   true,
+			Description: "The Proxmox password.",
+		},
+		"power_token_name": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "The Proxmox API token name.",
+		},
+		"power_token_secret": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Sensitive:   true,
+			Description: "The Proxmox API token secret.",
+		},
+		"power_user": {
+			Type:        schema.TypeString,
+			Required:    true,
+			Description: "The Proxmox user name.",
+		},
+		"power_verify_ssl": powerTypeVerifySSLSchema(),
+		"power_vm_name": {
+			Type:        schema.TypeString,
+			Required:    true,
+			Description: "The Proxmox VM ID or name.",
+		},
+	})
+}
+
+func powerTypeRedfishSchema() *schema.Schema {
+	return powerTypeBlockSchema("redfish", map[string]*schema.Schema{
+		"node_id": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "The Redfish node ID.",
+		},
+		"power_address": {
+			Type:        schema.TypeString,
+			Required:    true,
+			Description: "The Redfish address.",
+		},
+		"power_pass": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Sensitive:   true,
+			Description: "The Redfish password.",
+		},
+		"power_user": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "The Redfish user name.",
+		},
+	})
+}
+
+func powerTypeVirshSchema() *schema.Schema {
+	return powerTypeBlockSchema("virsh", map[string]*schema.Schema{
+		"power_address": {
+			Type:        schema.TypeString,
+			Required:    true,
+			Description: "The virsh address (e.g. `qemu+ssh://ubuntu@10.113.1.26/system`).",
+		},
+		"power_id": {
+			Type:        schema.TypeString,
+			Required:    true,
+			Description: "The virsh VM ID.",
+		},
+		"power_pass": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Sensitive:   true,
+			Description: "The virsh password.",
+		},
+	})
+}
+
+func powerTypeWebhookSchema() *schema.Schema {
+	return powerTypeBlockSchema("webhook", map[string]*schema.Schema{
+		"power_off_regex": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "The regex used to match the powered off state in the power query response.",
+		},
+		"power_off_uri": {
+			Type:        schema.TypeString,
+			Required:    true,
+			Description: "The URI used to power off the machine.",
+		},
+		"power_on_regex": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "The regex used to match the powered on state in the power query response.",
+		},
+		"power_on_uri": {
+			Type:        schema.TypeString,
+			Required:    true,
+			Description: "The URI used to power on the machine.",
+		},
+		"power_pass": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Sensitive:   true,
+			Description: "The password used for the webhook basic authentication.",
+		},
+		"power_query_uri": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "The URI used to query the machine power state.",
+		},
+		"power_token": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Sensitive:   true,
+			Description: "The bearer token used for the webhook authentication.",
+		},
+		"power_user": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "The user name used for the webhook basic authentication.",
+		},
+		"power_verify_ssl": powerTypeVerifySSLSchema(),
+	})
+}
+
+// getPowerTypeBlockParams returns the power parameters defined in a typed
+// power configuration block. Unset parameters are omitted.
+func getPowerTypeBlockParams(block map[string]interface{}) map[string]interface{} {
+	params := map[string]interface{}{}
+	for k, v := range block {
+		switch value := v.(type) {
+		case string:
+			if value != "" {
+				params[k] = value
+			}
+		case []interface{}:
+			if len(value) > 0 {
+				params[k] = value
+			}
+		}
+	}
+	return params
+}
@@ -0,0 +1,59 @@
+package maas
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePowerParameters(t *testing.T) {
+	powerType := &PowerType{
+		Name: "ipmi",
+		Fields: []PowerTypeField{
+			{Name: "power_driver", Required: true, Default: "LAN_2_0", Choices: [][]string{{"LAN", "LAN [IPMI 1.5]"}, {"LAN_2_0", "LAN_2_0 [IPMI 2.0]"}}},
+			{Name: "power_address", Required: true},
+			{Name: "power_user"},
+			{Name: "power_pass", Secret: true},
+			{Name: "workaround_flags", FieldType: "multiple_choice", Choices: [][]string{{"opensesspriv", "Opensesspriv"}, {"authcap", "Authcap"}}},
+		},
+	}
+
+	testCases := []struct {
+		name   string
+		params map[string]interface{}
+		valid  bool
+	}{
+		{
+			name:   "valid parameters",
+			params: map[string]interface{}{"power_address": "10.0.0.1", "power_user": "admin", "workaround_flags": []interface{}{"authcap"}},
+			valid:  true,
+		},
+		{
+			name:   "unknown parameter",
+			params: map[string]interface{}{"power_address": "10.0.0.1", "power_adress": "10.0.0.1"},
+		},
+		{
+			name:   "missing required parameter",
+			params: map[string]interface{}{"power_user": "admin"},
+		},
+		{
+			name:   "invalid choice",
+			params: map[string]interface{}{"power_address": "10.0.0.1", "power_driver": "LAN_3_0"},
+		},
+		{
+			name:   "invalid multiple choice",
+			params: map[string]interface{}{"power_address": "10.0.0.1", "workaround_flags": []interface{}{"authcap", "unknown"}},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := validatePowerParameters(powerType, testCase.params)
+			if testCase.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
 )
 
 func Provider() *schema.Provider {
@@ -30,6 +31,13 @@ func Provider() *schema.Provider {
 				Default:     "2.0",
 				Description: "The MAAS API version (default 2.0)",
 			},
+			"max_parallel_deployments": {
+				Type:             schema.TypeInt,
+				Optional:         true,
+				Default:          0,
+				ValidateDiagFunc: validation.ToDiagFunc(validation.IntAtLeast(0)),
+				Description:      "The maximum number of machines deployed, or commissioned, at the same time by the provider, so the rack controllers are not saturated by PXE boots. It's shared by `maas_instance`, `maas_instance_group`, `maas_vm_host` and `maas_machine`, and the queued operations are logged. Defaults to `0` (unlimited).",
+			},
 			"tls_ca_cert_path": {
 				Type:        schema.TypeString,
 				Optional:    true,
@@ -46,6 +54,7 @@ func Provider() *schema.Provider {
 		ResourcesMap: map[string]*schema.Resource{
 			"maas_device":                     resourceMaasDevice(),
 			"maas_instance":                   resourceMaasInstance(),
+			"maas_instance_group":             resourceMaasInstanceGroup(),
 			"maas_vm_host":                    resourceMaasVMHost(),
 			"maas_vm_host_machine":            resourceMaasVMHostMachine(),
 			"maas_machine":                    resourceMaasMachine(),
@@ -71,6 +80,8 @@ func Provider() *schema.Provider {
 			"maas_vlan":                       dataSourceMaasVlan(),
 			"maas_subnet":                     dataSourceMaasSubnet(),
 			"maas_machine":                    dataSourceMaasMachine(),
+			"maas_machines":                   dataSourceMaasMachines(),
+			"maas_allocation_candidates":      dataSourceMaasAllocationCandidates(),
 			"maas_network_interface_physical": dataSourceMaasNetworkInterfacePhysical(),
 			"maas_device":                     dataSourceMaasDevice(),
 			"maas_resource_pool":              dataSourceMaasResourcePool(),
@@ -110,5 +121,7 @@ func providerConfigure(ctx context.Context, d *schema.ResourceData) (interface{}
 		return nil, diags
 	}
 
+	setMaxParallelDeployments(c, d.Get("max_parallel_deployments").(int))
+
 	return c, diags
 }
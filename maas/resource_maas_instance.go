@@ -2,14 +2,31 @@ package maas
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/canonical/gomaasclient/client"
 	"github.com/canonical/gomaasclient/entity"
+	"github.com/canonical/gomaasclient/entity/event"
+	"github.com/google/go-querystring/query"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+	"github.com/juju/gomaasapi/v2"
+)
+
+const (
+	instanceOnDeployFailureKeep               = "keep"
+	instanceOnDeployFailureRelease            = "release"
+	instanceOnDeployFailureMarkBrokenAndRetry = "mark_broken_and_retry"
+	instanceOnDeployFailureReleaseAndRetry    = "release_and_retry"
 )
 
 func resourceMaasInstance() *schema.Resource {
@@ -17,7 +34,9 @@ func resourceMaasInstance() *schema.Resource {
 		Description:   "Provides a resource to deploy and release machines already configured in MAAS, based on the specified parameters. If no parameters are given, a random machine will be allocated and deployed using the defaults.\n\n**NOTE:** The MAAS provider currently provides both standalone resources and in-line resources for network interfaces. You cannot use in-line network interfaces in conjunction with any standalone network interfaces resources. Doing so will cause conflicts and will overwrite network configs.",
 		CreateContext: resourceInstanceCreate,
 		ReadContext:   resourceInstanceRead,
+		UpdateContext: resourceInstanceUpdate,
 		DeleteContext: resourceInstanceDelete,
+		CustomizeDiff: resourceInstanceCustomizeDiff,
 		Importer: &schema.ResourceImporter{
 			StateContext: func(ctx context.Context, d *schema.ResourceData, meta interface{}) ([]*schema.ResourceData, error) {
 				client := meta.(*client.Client)
@@ -41,177 +60,397 @@ func resourceMaasInstance() *schema.Resource {
 				ForceNew:    true,
 				MaxItems:    1,
 				Description: "Nested argument with the constraints used to machine allocation. Defined below.",
+				Elem: &schema.Resource{
+					Schema: getAllocateParamsSchema(true),
+				},
+			},
+			"block_devices_info": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "The block devices of the deployed MAAS machine. Defined below.",
+				Elem:        getInstanceBlockDeviceResource(),
+			},
+			"boot_disk": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "The boot disk of the deployed MAAS machine. Defined below.",
+				Elem:        getInstanceBlockDeviceResource(),
+			},
+			"boot_interface": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The name of the boot network interface of the deployed MAAS machine.",
+			},
+			"compose_if_needed": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Compose a VM when no machine matches the allocation constraints. The VM is composed on the `allocate_params.pod` VM host, or on the first `allocate_params.pod_type` VM host with enough resources, with the `arch`, `min_cpu_count` and `min_memory` constraints. The composed VM is decomposed when the instance is destroyed. It's only used when the instance is created. Defaults to `false`.",
+			},
+			"composed_on_vm_host": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The name of the VM host the machine was composed on, when it was composed by `compose_if_needed`.",
+			},
+			"cpu_count": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The number of CPU cores of the deployed MAAS machine.",
+			},
+			"deploy_params": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				MaxItems:    1,
+				Description: "Nested argument with the config used to deploy the allocated machine. Defined below. The options are checked against the MAAS version, and the image to be deployed against the images synced by MAAS. Changes to this argument replace the instance, unless `redeploy_on_change` is set.",
+				Elem: &schema.Resource{
+					Schema: getDeployParamsSchema(),
+				},
+			},
+			"description": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "The description of the deployed MAAS machine. It's updated in place.",
+			},
+			"distro_series": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The release of the OS deployed on the MAAS machine (e.g. `noble`).",
+			},
+			"domain": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "The domain of the deployed MAAS machine. It's updated in place.",
+			},
+			"fqdn": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The deployed MAAS machine FQDN.",
+			},
+			"hostname": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "The deployed MAAS machine hostname. It's updated in place.",
+			},
+			"hwe_kernel": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The kernel deployed on the MAAS machine (e.g. `ga-24.04`).",
+			},
+			"interface_matches": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "The network interfaces matching each label of the `allocate_params.interfaces` constraints. Defined below.",
 				Elem: &schema.Resource{
 					Schema: map[string]*schema.Schema{
-						"hostname": {
+						"label": {
 							Type:        schema.TypeString,
-							Optional:    true,
-							ForceNew:    true,
-							Description: "The hostname of the MAAS machine to be allocated.",
+							Computed:    true,
+							Description: "The network interface label.",
 						},
-						"min_cpu_count": {
-							Type:        schema.TypeInt,
-							Optional:    true,
-							Default:     0,
-							ForceNew:    true,
-							Description: "The minimum number of cores used to allocate the MAAS machine.",
+						"network_interfaces": {
+							Type:        schema.TypeList,
+							Computed:    true,
+							Description: "The names of the network interfaces matching the label.",
+							Elem: &schema.Schema{
+								Type: schema.TypeString,
+							},
 						},
-						"min_memory": {
-							Type:        schema.TypeInt,
-							Optional:    true,
-							Default:     0,
-							ForceNew:    true,
-							Description: "The minimum RAM memory size (in MB) used to allocate the MAAS machine.",
+					},
+				},
+			},
+			"ip_addresses": {
+				Type:        schema.TypeSet,
+				Computed:    true,
+				Description: "A set of IP addressed assigned to the deployed MAAS machine.",
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
+			"max_deploy_attempts": {
+				Type:             schema.TypeInt,
+				Optional:         true,
+				Default:          3,
+				ValidateDiagFunc: validation.ToDiagFunc(validation.IntAtLeast(1)),
+				Description:      "The maximum number of machines deployed, including the first one, when `on_deploy_failure` retries the deployment. Defaults to `3`.",
+			},
+			"memory": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The RAM memory size (in GiB) of the deployed MAAS machine.",
+			},
+			"network_interfaces": {
+				Type:        schema.TypeSet,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "Specifies a network interface configuration done before the machine is deployed. The bonds, bridges and VLANs are created before the network interfaces are linked to their subnets. Parameters defined below. This argument is processed in [attribute-as-blocks mode](https://www.terraform.io/docs/configuration/attr-as-blocks.html).",
+				Elem:        getInstanceNetworkInterfaceResource(),
+			},
+			"network_interfaces_info": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "The network interfaces of the deployed MAAS machine. Defined below.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"fabric": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The fabric of the network interface VLAN.",
+						},
+						"ip_address": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The IP address of the network interface link.",
 						},
-						"pool": {
+						"mac_address": {
 							Type:        schema.TypeString,
-							Optional:    true,
-							ForceNew:    true,
-							Description: "The pool name of the MAAS machine to be allocated.",
+							Computed:    true,
+							Description: "The MAC address of the network interface.",
 						},
-						"system_id": {
+						"mode": {
 							Type:        schema.TypeString,
-							Optional:    true,
-							ForceNew:    true,
-							Description: "The system_id of the MAAS machine to be allocated.",
+							Computed:    true,
+							Description: "The mode (`AUTO`, `DHCP`, `STATIC` or `LINK_UP`) of the network interface link.",
 						},
-						"tags": {
-							Type:        schema.TypeSet,
-							Optional:    true,
-							ForceNew:    true,
-							Description: "A set of tag names that must be assigned on the MAAS machine to be allocated.",
-							Elem: &schema.Schema{
-								Type: schema.TypeString,
-							},
+						"name": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The name of the network interface.",
 						},
-						"zone": {
+						"subnet_cidr": {
 							Type:        schema.TypeString,
-							Optional:    true,
-							ForceNew:    true,
-							Description: "The zone name of the MAAS machine to be allocated.",
+							Computed:    true,
+							Description: "The subnet CIDR of the network interface link.",
+						},
+						"type": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The type (`physical`, `bond`, `bridge` or `vlan`) of the network interface.",
+						},
+						"vlan": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "The VID of the network interface VLAN.",
 						},
 					},
 				},
 			},
-			"cpu_count": {
-				Type:        schema.TypeInt,
+			"on_deploy_failure": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				Default:          instanceOnDeployFailureKeep,
+				ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice([]string{instanceOnDeployFailureKeep, instanceOnDeployFailureRelease, instanceOnDeployFailureMarkBrokenAndRetry, instanceOnDeployFailureReleaseAndRetry}, false)),
+				Description:      "The policy applied when the machine fails to be deployed. Supported values are: `keep` (the failed machine is kept allocated, and the instance is tainted), `release` (the failed machine is released), `mark_broken_and_retry` (the failed machine is marked broken, and another machine is deployed), `release_and_retry` (the failed machine is released, and another machine is deployed). The machines are retried up to `max_deploy_attempts`, and the failed machines are excluded from the next allocations. The failure events are reported as warnings. Defaults to `keep`.",
+			},
+			"osystem": {
+				Type:        schema.TypeString,
 				Computed:    true,
-				Description: "The number of CPU cores of the deployed MAAS machine.",
+				Description: "The OS deployed on the MAAS machine (e.g. `ubuntu`).",
 			},
-			"deploy_params": {
+			"owner_data": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "The owner data of the MAAS machine, as key/value pairs visible to every MAAS user (e.g. the team or the service using the machine). It's set right after the machine is allocated, and updated in place.",
+			},
+			"pool": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "The deployed MAAS machine pool name. It's updated in place, unlike the `allocate_params.pool` constraint.",
+			},
+			"power_state": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The power state of the deployed MAAS machine.",
+			},
+			"redeploy_on_change": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Redeploy the same machine when `deploy_params` change, instead of replacing the instance. The machine is released, without erasing its disks, and deployed again, keeping its system ID, network interfaces configuration, tags and owner data. When the redeployment fails, the machine is kept with the previous `deploy_params` with the `keep` policy of `on_deploy_failure`, otherwise it's released or marked broken and another machine is deployed by the next apply. Defaults to `false`.",
+			},
+			"release_params": {
 				Type:        schema.TypeList,
 				Optional:    true,
-				ForceNew:    true,
 				MaxItems:    1,
-				Description: "Nested argument with the config used to deploy the allocated machine. Defined below.",
+				Description: "Nested argument with the config used to release the machine when the resource is destroyed. Defined below. Changes to this argument must be applied before they are used by a destroy.",
 				Elem: &schema.Resource{
 					Schema: map[string]*schema.Schema{
-						"distro_series": {
-							Type:        schema.TypeString,
+						"comment": {
+							Type:             schema.TypeString,
+							Optional:         true,
+							Default:          "Released by Terraform",
+							ValidateDiagFunc: isTemplate,
+							Description:      "The comment recorded in the machine event log when it is released. It is a Go template, where `{{ .Hostname }}`, `{{ .FQDN }}` and `{{ .SystemID }}` are replaced with the machine details. Defaults to `Released by Terraform`.",
+						},
+						"erase": {
+							Type:        schema.TypeBool,
 							Optional:    true,
-							ForceNew:    true,
-							Description: "The distro series used to deploy the allocated MAAS machine. If it's not given, the MAAS server default value is used.",
+							Default:     false,
+							Description: "Erase the machine disks when it is released.",
 						},
-						"enable_hw_sync": {
+						"force": {
 							Type:        schema.TypeBool,
 							Optional:    true,
-							ForceNew:    true,
-							Description: "Periodically sync hardware",
+							Default:     false,
+							Description: "Release the machine even if it has VM hosts, or VMs, still deployed on it.",
 						},
-						"ephemeral": {
+						"quick_erase": {
 							Type:        schema.TypeBool,
 							Optional:    true,
-							ForceNew:    true,
-							Description: "Deploy machine in memory",
+							Default:     false,
+							Description: "Wipe 2MiB at the start and at the end of the machine disks when it is released. This implies `erase`.",
 						},
-						"hwe_kernel": {
-							Type:        schema.TypeString,
+						"scripts": {
+							Type:        schema.TypeList,
 							Optional:    true,
-							ForceNew:    true,
-							Description: "Hardware enablement kernel to use with the image. Only used when deploying Ubuntu.",
+							Description: "A list of release script names, or tags, run when the machine is released (MAAS 3.5 or later). If it's not given, the MAAS server default release scripts are run.",
+							Elem: &schema.Schema{
+								Type: schema.TypeString,
+							},
 						},
-						"user_data": {
-							Type:        schema.TypeString,
+						"secure_erase": {
+							Type:        schema.TypeBool,
 							Optional:    true,
-							ForceNew:    true,
-							Description: "Cloud-init user data script that gets run on the machine once it has deployed. A good practice is to set this with `file(\"/tmp/user-data.txt\")`, where `/tmp/user-data.txt` is a cloud-init script.",
+							Default:     false,
+							Description: "Use the secure erase feature of the machine disks, if available, when it is released. This implies `erase`.",
 						},
 					},
 				},
 			},
-			"fqdn": {
-				Type:        schema.TypeString,
-				Computed:    true,
-				Description: "The deployed MAAS machine FQDN.",
-			},
-			"hostname": {
+			"status": {
 				Type:        schema.TypeString,
 				Computed:    true,
-				Description: "The deployed MAAS machine hostname.",
-			},
-			"ip_addresses": {
-				Type:        schema.TypeSet,
-				Computed:    true,
-				Description: "A set of IP addressed assigned to the deployed MAAS machine.",
-				Elem: &schema.Schema{
-					Type: schema.TypeString,
-				},
+				Description: "The status of the deployed MAAS machine (e.g. `Deployed`).",
 			},
-			"memory": {
+			"storage": {
 				Type:        schema.TypeInt,
 				Computed:    true,
-				Description: "The RAM memory size (in GiB) of the deployed MAAS machine.",
+				Description: "The total storage of the deployed MAAS machine, in MB.",
 			},
-			"network_interfaces": {
-				Type:        schema.TypeSet,
+			"storage_layout": {
+				Type:        schema.TypeList,
 				Optional:    true,
 				ForceNew:    true,
-				Description: "Specifies a network interface configuration done before the machine is deployed. Parameters defined below. This argument is processed in [attribute-as-blocks mode](https://www.terraform.io/docs/configuration/attr-as-blocks.html).",
+				MaxItems:    1,
+				Description: "Nested argument with the storage layout applied to the allocated machine before it is deployed. Defined below.",
 				Elem: &schema.Resource{
 					Schema: map[string]*schema.Schema{
-						"ip_address": {
+						"boot_size": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							ForceNew:    true,
+							Description: "The size of the boot partition on the root device (e.g. `1G`). If it's not given, the MAAS server default value is used.",
+						},
+						"cache_device": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							ForceNew:    true,
+							Description: "The name, or ID, of the block device used as the cache device. Only used by the `bcache` layout. If it's not given, the first SSD is used.",
+						},
+						"cache_mode": {
 							Type:             schema.TypeString,
 							Optional:         true,
 							ForceNew:         true,
-							ValidateDiagFunc: validation.ToDiagFunc(validation.IsIPAddress),
-							Description:      "Static IP address to be configured on the network interface. If this is set, the `subnet_cidr` is required.\n\n**NOTE:** If both `subnet_cidr` and `ip_address` are not defined, the interface will not be configured on the allocated machine.",
+							ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice([]string{"writeback", "writethrough", "writearound"}, false)),
+							Description:      "The cache mode. Only used by the `bcache` layout. Supported values are: `writeback`, `writethrough`, `writearound`. If it's not given, the MAAS server default value is used.",
 						},
-						"name": {
+						"cache_no_part": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							ForceNew:    true,
+							Description: "Use the whole cache device, without partitioning it. Only used by the `bcache` layout.",
+						},
+						"cache_size": {
 							Type:        schema.TypeString,
-							Required:    true,
+							Optional:    true,
 							ForceNew:    true,
-							Description: "The name of the network interface to be configured on the allocated machine.",
+							Description: "The size of the cache partition on the cache device (e.g. `100G`). Only used by the `bcache` layout.",
 						},
-						"subnet_cidr": {
+						"layout": {
+							Type:             schema.TypeString,
+							Required:         true,
+							ForceNew:         true,
+							ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice([]string{"flat", "lvm", "bcache", "vmfs6", "vmfs7", "blank"}, false)),
+							Description:      "The storage layout. Supported values are: `flat`, `lvm`, `bcache`, `vmfs6`, `vmfs7`, `blank`.",
+						},
+						"lv_name": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							ForceNew:    true,
+							Description: "The name of the root logical volume. Only used by the `lvm` layout.",
+						},
+						"lv_size": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							ForceNew:    true,
+							Description: "The size of the root logical volume (e.g. `100G`). Only used by the `lvm` layout.",
+						},
+						"root_device": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							ForceNew:    true,
+							Description: "The name, or ID, of the block device used as the root device. If it's not given, the boot disk is used.",
+						},
+						"root_size": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							ForceNew:    true,
+							Description: "The size of the root partition (e.g. `100G`). If it's not given, the whole root device is used.",
+						},
+						"vg_name": {
 							Type:        schema.TypeString,
 							Optional:    true,
 							ForceNew:    true,
-							Description: "An existing subnet CIDR used to configure the network interface. Unless `ip_address` is defined, a free IP address is allocated from the subnet.",
+							Description: "The name of the volume group. Only used by the `lvm` layout.",
 						},
 					},
 				},
 			},
-			"pool": {
-				Type:        schema.TypeString,
+			"storage_matches": {
+				Type:        schema.TypeList,
 				Computed:    true,
-				Description: "The deployed MAAS machine pool name.",
+				Description: "The block devices matching each label of the `allocate_params.storage` constraints. Defined below.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"block_devices": {
+							Type:        schema.TypeList,
+							Computed:    true,
+							Description: "The names of the block devices matching the storage label.",
+							Elem: &schema.Schema{
+								Type: schema.TypeString,
+							},
+						},
+						"label": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The storage label.",
+						},
+					},
+				},
 			},
 			"tags": {
 				Type:        schema.TypeSet,
+				Optional:    true,
 				Computed:    true,
-				Description: "A set of tag names associated to the deployed MAAS machine.",
+				Description: "A set of tag names associated to the deployed MAAS machine. The tags must exist, and they're added to, or removed from, the machine in place. The automatic tags matching the machine must be listed too, and the kernel options tag set by `deploy_params.kernel_opts` is ignored.",
 				Elem: &schema.Schema{
 					Type: schema.TypeString,
 				},
 			},
 			"zone": {
 				Type:        schema.TypeString,
+				Optional:    true,
 				Computed:    true,
-				Description: "The deployed MAAS machine zone name.",
+				Description: "The deployed MAAS machine zone name. It's updated in place, unlike the `allocate_params.zone` constraint.",
 			},
 		},
 		Timeouts: &schema.ResourceTimeout{
 			Create: schema.DefaultTimeout(30 * time.Minute),
+			Update: schema.DefaultTimeout(30 * time.Minute),
 			Delete: schema.DefaultTimeout(30 * time.Minute),
 		},
 	}
@@ -220,35 +459,243 @@ func resourceMaasInstance() *schema.Resource {
 func resourceInstanceCreate(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
 	client := meta.(*client.Client)
 
-	// Allocate MAAS machine
-	machine, err := client.Machines.Allocate(getMachinesAllocateParams(d))
+	var diags diag.Diagnostics
+	onDeployFailure := d.Get("on_deploy_failure").(string)
+	maxAttempts := 1
+	if onDeployFailure == instanceOnDeployFailureMarkBrokenAndRetry || onDeployFailure == instanceOnDeployFailureReleaseAndRetry {
+		maxAttempts = d.Get("max_deploy_attempts").(int)
+	}
+	allocateParams := getMachinesAllocateParams(d)
+	for attempt := 1; ; attempt++ {
+		machine, err := deployInstance(ctx, client, d, allocateParams)
+		if err != nil {
+			return append(diags, diag.FromErr(err)...)
+		}
+		if machine.StatusName == "Deployed" {
+			break
+		}
+
+		// Handle the failed deployment
+		diags = append(diags, getDeployFailureDiagnostic(client, machine, attempt, maxAttempts))
+		if onDeployFailure == instanceOnDeployFailureKeep {
+			return append(diags, diag.Errorf("machine (%s) failed to be deployed: %s", machine.Hostname, machine.StatusName)...)
+		}
+		if err := handleInstanceDeployFailure(ctx, client, d, machine, onDeployFailure); err != nil {
+			return append(diags, diag.FromErr(err)...)
+		}
+		d.SetId("")
+		if attempt >= maxAttempts {
+			return append(diags, diag.Errorf("machine deployment failed after %d attempt(s)", attempt)...)
+		}
+
+		// Retry with another machine
+		allocateParams.NotID = append(allocateParams.NotID, machine.SystemID)
+	}
+
+	// Update the machine properties
+	if err := updateInstanceMachine(client, d); err != nil {
+		return append(diags, diag.FromErr(err)...)
+	}
+
+	// Read MAAS machine info
+	return append(diags, resourceInstanceRead(ctx, d, meta)...)
+}
+
+// deployInstance allocates a machine, configures and deploys it, and waits
+// for the deployment to end. The deployed, or failed, machine is returned.
+func deployInstance(ctx context.Context, client *client.Client, d *schema.ResourceData, allocateParams *machineAllocateParams) (*entity.Machine, error) {
+	// Allocate MAAS machine, or compose a VM when no machine matches
+	machine, constraints, err := allocateMachine(client, allocateParams)
+	composedOn := ""
+	if serverErr, ok := gomaasapi.GetServerError(err); ok && serverErr.StatusCode == http.StatusConflict && d.Get("compose_if_needed").(bool) {
+		machine, constraints, composedOn, err = composeInstanceMachine(ctx, client, allocateParams, d.Timeout(schema.TimeoutCreate))
+	}
 	if err != nil {
-		return diag.FromErr(err)
+		return nil, err
 	}
 
 	// Save system id
 	d.SetId(machine.SystemID)
+	if err := d.Set("composed_on_vm_host", composedOn); err != nil {
+		return nil, err
+	}
+
+	// Set the owner data of the machine
+	if ownerData := d.Get("owner_data").(map[string]interface{}); len(ownerData) > 0 {
+		if err := setMachineOwnerData(client, machine.SystemID, getOwnerDataParams(nil, ownerData)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Save the block devices matched by the storage constraints
+	if err := d.Set("storage_matches", getStorageMatches(machine, constraints.Storage)); err != nil {
+		return nil, err
+	}
+	// Save the network interfaces matched by the interfaces constraints
+	if err := d.Set("interface_matches", getInterfaceMatches(machine, constraints.Interfaces)); err != nil {
+		return nil, err
+	}
+
+	// Configure storage layout
+	if p, ok := d.GetOk("storage_layout"); ok {
+		if err := setMachineStorageLayout(client, machine.SystemID, p.([]interface{})[0].(map[string]interface{})); err != nil {
+			return nil, err
+		}
+	}
 
 	// Configure network interfaces
-	err = configureInstanceNetworkInterfaces(client, d, machine)
+	err = configureInstanceNetworkInterfaces(client, d, machine, constraints.Interfaces)
 	if err != nil {
-		return diag.FromErr(err)
+		return nil, err
 	}
 
-	// Deploy MAAS machine
-	machine, err = client.Machine.Deploy(machine.SystemID, getMachineDeployParams(d))
-	if err != nil {
-		return diag.FromErr(err)
+	// Set the kernel options of the machine
+	if kernelOpts := d.Get("deploy_params.0.kernel_opts").(string); kernelOpts != "" {
+		if err := setMachineKernelOpts(client, machine.SystemID, kernelOpts); err != nil {
+			return nil, err
+		}
 	}
 
-	// Wait for MAAS machine to be deployed
-	_, err = waitForMachineStatus(ctx, client, machine.SystemID, []string{"Deploying"}, []string{"Deployed"}, d.Timeout(schema.TimeoutCreate))
+	// Wait for a deployment slot, held until the deployment ends
+	releaseSlot, err := acquireDeploymentSlots(ctx, client, 1, fmt.Sprintf("Deployment of machine (%s)", machine.Hostname))
 	if err != nil {
-		return diag.FromErr(err)
+		return nil, err
 	}
+	defer releaseSlot()
 
-	// Read MAAS machine info
-	return resourceInstanceRead(ctx, d, meta)
+	// Deploy MAAS machine
+	deployParams, err := getMachineDeployParams(d)
+	if err != nil {
+		return nil, err
+	}
+	machine, err = deployMachine(client, machine.SystemID, deployParams)
+	if err != nil {
+		return nil, err
+	}
+
+	// Wait for MAAS machine to be deployed, or to fail
+	return waitForMachineStatus(ctx, client, machine.SystemID, []string{"Deploying"}, []string{"Deployed", "Failed deployment"}, d.Timeout(schema.TimeoutCreate))
+}
+
+// handleInstanceDeployFailure releases, or marks broken, the machine that
+// failed to be deployed, according to the `on_deploy_failure` policy.
+func handleInstanceDeployFailure(ctx context.Context, client *client.Client, d *schema.ResourceData, machine *entity.Machine, onDeployFailure string) error {
+	switch onDeployFailure {
+	case instanceOnDeployFailureMarkBrokenAndRetry:
+		if _, err := client.Machine.MarkBroken(machine.SystemID, "Deployment failed with Terraform"); err != nil {
+			return err
+		}
+	default:
+		releaseParams := &entity.MachineReleaseParams{Comment: "Released by Terraform after a failed deployment"}
+		if err := releaseMachine(ctx, client, machine.SystemID, releaseParams, nil, d.Timeout(schema.TimeoutCreate)); err != nil {
+			return err
+		}
+	}
+
+	// Delete the kernel options of the machine
+	if d.Get("deploy_params.0.kernel_opts").(string) != "" {
+		if err := deleteMachineKernelOpts(client, machine.SystemID); err != nil {
+			return err
+		}
+	}
+	return decomposeInstanceMachine(client, d, machine.SystemID)
+}
+
+// composeInstanceMachine composes a VM matching the allocation constraints,
+// and allocates it. The VM hosts matching the `pod` and `pod_type` constraints
+// are tried in turn, until one has enough resources.
+func composeInstanceMachine(ctx context.Context, client *client.Client, allocateParams *machineAllocateParams, timeout time.Duration) (*entity.Machine, *machineConstraintsByType, string, error) {
+	vmHosts, err := client.VMHosts.Get()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	sort.Slice(vmHosts, func(i, j int) bool {
+		return vmHosts[i].Name < vmHosts[j].Name
+	})
+
+	composeParams := &entity.VMHostMachineParams{
+		Architecture: allocateParams.Arch,
+		Cores:        allocateParams.CPUCount,
+		Memory:       allocateParams.Mem,
+	}
+	var errs []string
+	for _, vmHost := range vmHosts {
+		if (allocateParams.VMHost != "" && vmHost.Name != allocateParams.VMHost) || (allocateParams.VMHostType != "" && vmHost.Type != allocateParams.VMHostType) {
+			continue
+		}
+		composed, err := client.VMHost.Compose(vmHost.ID, composeParams)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", vmHost.Name, err))
+			continue
+		}
+		log.Printf("[INFO] Composed machine (%s) on VM host (%s)\n", composed.SystemID, vmHost.Name)
+		machine, constraints, err := allocateComposedMachine(ctx, client, composed, allocateParams, timeout)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		return machine, constraints, vmHost.Name, nil
+	}
+
+	if len(errs) == 0 {
+		return nil, nil, "", fmt.Errorf("no machine matches the allocation constraints, and no VM host matches 'pod' (%s) and 'pod_type' (%s) to compose one", allocateParams.VMHost, allocateParams.VMHostType)
+	}
+	return nil, nil, "", fmt.Errorf("no machine matches the allocation constraints, and no VM host can compose one: %s", strings.Join(errs, "; "))
+}
+
+// allocateComposedMachine waits for the composed VM to be commissioned, and
+// allocates it. The VM is decomposed when it cannot be allocated, so it's not
+// left on its VM host.
+func allocateComposedMachine(ctx context.Context, client *client.Client, composed *entity.Machine, allocateParams *machineAllocateParams, timeout time.Duration) (machine *entity.Machine, constraints *machineConstraintsByType, err error) {
+	defer func() {
+		if err == nil {
+			return
+		}
+		if deleteErr := client.Machine.Delete(composed.SystemID); deleteErr != nil {
+			log.Printf("[WARN] Unable to decompose machine (%s): %s\n", composed.SystemID, deleteErr)
+		}
+	}()
+
+	if _, err = waitForMachineStatus(ctx, client, composed.SystemID, []string{"New", "Commissioning", "Testing"}, []string{"Ready"}, timeout); err != nil {
+		return nil, nil, fmt.Errorf("composed machine (%s) failed to be commissioned: %w", composed.Hostname, err)
+	}
+	params := *allocateParams
+	params.SystemID = composed.SystemID
+	params.NotID = nil
+	if machine, constraints, err = allocateMachine(client, &params); err != nil {
+		return nil, nil, fmt.Errorf("composed machine (%s) doesn't match the allocation constraints: %w", composed.Hostname, err)
+	}
+	return machine, constraints, nil
+}
+
+// decomposeInstanceMachine deletes the machine, if it was composed by
+// `compose_if_needed`, so the VM is removed from its VM host.
+func decomposeInstanceMachine(client *client.Client, d *schema.ResourceData, systemID string) error {
+	if d.Get("composed_on_vm_host").(string) == "" {
+		return nil
+	}
+	return client.Machine.Delete(systemID)
+}
+
+// getDeployFailureDiagnostic returns a warning with the latest error events of
+// the machine that failed to be deployed.
+func getDeployFailureDiagnostic(client *client.Client, machine *entity.Machine, attempt int, maxAttempts int) diag.Diagnostic {
+	detail := machine.StatusMessage
+	events, err := client.Events.Get(&entity.EventParams{ID: machine.SystemID, Level: event.WARNING, Limit: "5"})
+	if err != nil {
+		log.Printf("[WARN] Unable to get the events of machine (%s): %s\n", machine.SystemID, err)
+	} else if len(events.Events) > 0 {
+		descriptions := make([]string, len(events.Events))
+		for i, e := range events.Events {
+			descriptions[i] = fmt.Sprintf("%s: %s %s", e.Created, e.Type, e.Description)
+		}
+		detail = strings.Join(descriptions, "\n")
+	}
+
+	return diag.Diagnostic{
+		Severity: diag.Warning,
+		Summary:  fmt.Sprintf("Deployment of machine (%s) failed, attempt %d of %d", machine.Hostname, attempt, maxAttempts),
+		Detail:   detail,
+	}
 }
 
 func resourceInstanceRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
@@ -264,15 +711,51 @@ func resourceInstanceRead(ctx context.Context, d *schema.ResourceData, meta inte
 	for i, ip := range machine.IPAddresses {
 		ipAddresses[i] = ip.String()
 	}
+	// The kernel options tag is managed by the deploy params
+	tags := []string{}
+	for _, tag := range machine.TagNames {
+		if tag != getKernelOptsTagName(machine.SystemID) {
+			tags = append(tags, tag)
+		}
+	}
+	networkInterfaces, err := client.NetworkInterfaces.Get(machine.SystemID)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+	blockDevices, err := client.BlockDevices.Get(machine.SystemID)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+	blockDevicesInfo := make([]map[string]interface{}, len(blockDevices))
+	for i, blockDevice := range blockDevices {
+		blockDevicesInfo[i] = getInstanceBlockDeviceState(blockDevice)
+	}
+	bootDisk := []map[string]interface{}{}
+	if machine.BootDisk.ID != 0 {
+		bootDisk = append(bootDisk, getInstanceBlockDeviceState(machine.BootDisk))
+	}
 	tfState := map[string]interface{}{
-		"fqdn":         machine.FQDN,
-		"hostname":     machine.Hostname,
-		"zone":         machine.Zone.Name,
-		"pool":         machine.Pool.Name,
-		"tags":         machine.TagNames,
-		"cpu_count":    machine.CPUCount,
-		"memory":       machine.Memory,
-		"ip_addresses": ipAddresses,
+		"block_devices_info":      blockDevicesInfo,
+		"boot_disk":               bootDisk,
+		"boot_interface":          machine.BootInterface.Name,
+		"distro_series":           machine.DistroSeries,
+		"hwe_kernel":              machine.HWEKernel,
+		"network_interfaces_info": getInstanceNetworkInterfacesInfo(networkInterfaces),
+		"osystem":                 machine.OSystem,
+		"power_state":             machine.PowerState,
+		"status":                  machine.StatusName,
+		"storage":                 int(machine.Storage),
+		"owner_data":              getMachineOwnerData(machine),
+		"description":             machine.Description,
+		"domain":                  machine.Domain.Name,
+		"fqdn":                    machine.FQDN,
+		"hostname":                machine.Hostname,
+		"zone":                    machine.Zone.Name,
+		"pool":                    machine.Pool.Name,
+		"tags":                    tags,
+		"cpu_count":               machine.CPUCount,
+		"memory":                  machine.Memory,
+		"ip_addresses":            ipAddresses,
 	}
 	if err := setTerraformState(d, tfState); err != nil {
 		return diag.FromErr(err)
@@ -281,105 +764,859 @@ func resourceInstanceRead(ctx context.Context, d *schema.ResourceData, meta inte
 	return nil
 }
 
+func resourceInstanceUpdate(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*client.Client)
+
+	// Redeploy the same machine with the new deploy params
+	if d.HasChange("deploy_params") {
+		machine, err := redeployInstance(ctx, client, d)
+		if err != nil {
+			return diag.FromErr(err)
+		}
+		if machine.StatusName != "Deployed" {
+			return handleInstanceRedeployFailure(ctx, client, d, machine)
+		}
+	}
+
+	// Update the machine properties
+	if err := updateInstanceMachine(client, d); err != nil {
+		return diag.FromErr(err)
+	}
+
+	return resourceInstanceRead(ctx, d, meta)
+}
+
+func getMachineOwnerData(machine *entity.Machine) map[string]string {
+	ownerData := map[string]string{}
+	if data, ok := machine.OwnerData.(map[string]interface{}); ok {
+		for k, v := range data {
+			ownerData[k] = fmt.Sprint(v)
+		}
+	}
+	return ownerData
+}
+
+// getInstanceBlockDeviceResource returns the schema of the block devices
+// reported by `boot_disk` and `block_devices_info`.
+func getInstanceBlockDeviceResource() *schema.Resource {
+	return &schema.Resource{
+		Schema: map[string]*schema.Schema{
+			"id_path": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The path of the block device, unique across reboots.",
+			},
+			"model": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The model of the block device.",
+			},
+			"name": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The name of the block device.",
+			},
+			"serial": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The serial number of the block device.",
+			},
+			"size_gigabytes": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The size of the block device, in GB.",
+			},
+			"used_for": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "What the block device is used for (e.g. `GPT partitioned with 2 partitions`).",
+			},
+		},
+	}
+}
+
+func getInstanceBlockDeviceState(blockDevice entity.BlockDevice) map[string]interface{} {
+	return map[string]interface{}{
+		"id_path":        blockDevice.IDPath,
+		"model":          blockDevice.Model,
+		"name":           blockDevice.Name,
+		"serial":         blockDevice.Serial,
+		"size_gigabytes": int(blockDevice.Size / (1024 * 1024 * 1024)),
+		"used_for":       blockDevice.UsedFor,
+	}
+}
+
+// getInstanceNetworkInterfacesInfo returns the state of the network interfaces
+// of the machine, with their first link. The links of the disconnected network
+// interfaces are empty.
+func getInstanceNetworkInterfacesInfo(networkInterfaces []entity.NetworkInterface) []map[string]interface{} {
+	networkInterfacesInfo := make([]map[string]interface{}, len(networkInterfaces))
+	for i, networkInterface := range networkInterfaces {
+		info := map[string]interface{}{
+			"fabric":      networkInterface.VLAN.Fabric,
+			"ip_address":  "",
+			"mac_address": networkInterface.MACAddress,
+			"mode":        "",
+			"name":        networkInterface.Name,
+			"subnet_cidr": "",
+			"type":        networkInterface.Type,
+			"vlan":        networkInterface.VLAN.VID,
+		}
+		if len(networkInterface.Links) > 0 {
+			link := networkInterface.Links[0]
+			info["ip_address"] = link.IPAddress
+			info["mode"] = strings.ToUpper(link.Mode)
+			info["subnet_cidr"] = link.Subnet.CIDR
+		}
+		networkInterfacesInfo[i] = info
+	}
+	return networkInterfacesInfo
+}
+
+// updateInstanceMachine updates the hostname, domain, description, pool, zone
+// and tags of the machine, when they're changed.
+func updateInstanceMachine(client *client.Client, d *schema.ResourceData) error {
+	if d.HasChanges("description", "domain", "hostname", "pool", "zone") {
+		if err := updateMachine(client, d.Id(), getInstanceMachineParams(d)); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("owner_data") {
+		oldOwnerData, newOwnerData := d.GetChange("owner_data")
+		if err := setMachineOwnerData(client, d.Id(), getOwnerDataParams(oldOwnerData.(map[string]interface{}), newOwnerData.(map[string]interface{}))); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("tags") {
+		oldTags, newTags := d.GetChange("tags")
+		return updateMachineTags(client, d.Id(), convertToStringSlice(oldTags.(*schema.Set).List()), convertToStringSlice(newTags.(*schema.Set).List()))
+	}
+
+	return nil
+}
+
+// getInstanceMachineParams returns the machine parameters to be updated. The
+// description is always sent, so it's cleared when it's removed.
+func getInstanceMachineParams(d *schema.ResourceData) url.Values {
+	params := url.Values{}
+	params.Set("description", d.Get("description").(string))
+	for _, k := range []string{"domain", "hostname", "pool", "zone"} {
+		if v := d.Get(k).(string); v != "" {
+			params.Set(k, v)
+		}
+	}
+	return params
+}
+
+// updateMachine updates the machine with the MAAS API client directly, since
+// gomaasclient omits the empty parameters.
+func updateMachine(client *client.Client, systemID string, params url.Values) error {
+	apiClient, err := getAPIClient(client)
+	if err != nil {
+		return err
+	}
+	return apiClient.GetSubObject("machines").GetSubObject(systemID).Put(params, func(data []byte) error {
+		return nil
+	})
+}
+
+// getOwnerDataParams returns the owner data to be set on the machine. The
+// removed keys are set to an empty value, so MAAS deletes them.
+func getOwnerDataParams(oldOwnerData map[string]interface{}, newOwnerData map[string]interface{}) url.Values {
+	params := url.Values{}
+	for k := range oldOwnerData {
+		params.Set(k, "")
+	}
+	for k, v := range newOwnerData {
+		params.Set(k, v.(string))
+	}
+	return params
+}
+
+// setMachineOwnerData sets the owner data of the allocated machine. It's not
+// supported by gomaasclient, so the MAAS API client is used directly.
+func setMachineOwnerData(client *client.Client, systemID string, params url.Values) error {
+	if len(params) == 0 {
+		return nil
+	}
+	apiClient, err := getAPIClient(client)
+	if err != nil {
+		return err
+	}
+	return apiClient.GetSubObject("machines").GetSubObject(systemID).Post("set_owner_data", params, func(data []byte) error {
+		return nil
+	})
+}
+
+// updateMachineTags adds the new tags to the machine, and removes the old
+// ones that are not wanted anymore.
+func updateMachineTags(client *client.Client, systemID string, oldTags []string, newTags []string) error {
+	wanted := map[string]bool{}
+	for _, tag := range newTags {
+		wanted[tag] = true
+	}
+	for _, tag := range oldTags {
+		if !wanted[tag] && tag != getKernelOptsTagName(systemID) {
+			if err := client.Tag.RemoveMachines(tag, []string{systemID}); err != nil {
+				return err
+			}
+		}
+		delete(wanted, tag)
+	}
+	for _, tag := range newTags {
+		if wanted[tag] {
+			if err := client.Tag.AddMachines(tag, []string{systemID}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// redeployInstance releases the machine of the instance, and deploys it again
+// with the new deploy params. The machine is allocated again by its system ID,
+// so it keeps its network interfaces configuration, storage layout and tags.
+func redeployInstance(ctx context.Context, client *client.Client, d *schema.ResourceData) (*entity.Machine, error) {
+	systemID := d.Id()
+
+	// Release MAAS machine, and wait for it to be ready
+	releaseParams := &entity.MachineReleaseParams{Comment: "Released by Terraform for redeployment"}
+	if err := releaseMachine(ctx, client, systemID, releaseParams, nil, d.Timeout(schema.TimeoutUpdate)); err != nil {
+		return nil, err
+	}
+
+	// Allocate the same MAAS machine
+	allocateParams := &machineAllocateParams{
+		MachineAllocateParams: entity.MachineAllocateParams{
+			SystemID:  systemID,
+			AgentName: d.Get("allocate_params.0.agent_name").(string),
+		},
+	}
+	if _, _, err := allocateMachine(client, allocateParams); err != nil {
+		return nil, err
+	}
+
+	// Set the owner data again, it's cleared by MAAS on release
+	if err := setMachineOwnerData(client, systemID, getOwnerDataParams(nil, d.Get("owner_data").(map[string]interface{}))); err != nil {
+		return nil, err
+	}
+
+	// Update the kernel options of the machine
+	if d.HasChange("deploy_params.0.kernel_opts") {
+		oldKernelOpts, newKernelOpts := d.GetChange("deploy_params.0.kernel_opts")
+		if oldKernelOpts.(string) != "" {
+			if err := deleteMachineKernelOpts(client, systemID); err != nil {
+				return nil, err
+			}
+		}
+		if newKernelOpts.(string) != "" {
+			if err := setMachineKernelOpts(client, systemID, newKernelOpts.(string)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Deploy MAAS machine, and wait for it to be deployed, or to fail
+	deployParams, err := getMachineDeployParams(d)
+	if err != nil {
+		return nil, err
+	}
+	releaseSlot, err := acquireDeploymentSlots(ctx, client, 1, fmt.Sprintf("Redeployment of machine (%s)", systemID))
+	if err != nil {
+		return nil, err
+	}
+	defer releaseSlot()
+	if _, err := deployMachine(client, systemID, deployParams); err != nil {
+		return nil, err
+	}
+	return waitForMachineStatus(ctx, client, systemID, []string{"Deploying"}, []string{"Deployed", "Failed deployment"}, d.Timeout(schema.TimeoutUpdate))
+}
+
+// handleInstanceRedeployFailure applies the `on_deploy_failure` policy to a
+// failed redeployment. With `keep`, the failed machine stays in the state with
+// the previous deploy params, so the redeployment is tried again by the next
+// apply. Otherwise, the machine is released or marked broken, and removed from
+// the state, so another machine is deployed by the next apply.
+func handleInstanceRedeployFailure(ctx context.Context, client *client.Client, d *schema.ResourceData, machine *entity.Machine) diag.Diagnostics {
+	diags := diag.Diagnostics{getDeployFailureDiagnostic(client, machine, 1, 1)}
+	onDeployFailure := d.Get("on_deploy_failure").(string)
+	if onDeployFailure == instanceOnDeployFailureKeep {
+		d.Partial(true)
+		return append(diags, diag.Errorf("machine (%s) failed to be redeployed: %s", machine.Hostname, machine.StatusName)...)
+	}
+	if err := handleInstanceDeployFailure(ctx, client, d, machine, onDeployFailure); err != nil {
+		return append(diags, diag.FromErr(err)...)
+	}
+	d.SetId("")
+	return append(diags, diag.Errorf("machine (%s) failed to be redeployed, and was removed from the instance: another machine is deployed by the next apply", machine.Hostname)...)
+}
+
 func resourceInstanceDelete(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
 	client := meta.(*client.Client)
 
-	// Release MAAS machine
-	err := client.Machines.Release([]string{d.Id()}, "Released by Terraform")
+	machine, err := client.Machine.Get(d.Id())
 	if err != nil {
 		return diag.FromErr(err)
 	}
-
-	// Wait MAAS machine to be released
-	_, err = waitForMachineStatus(ctx, client, d.Id(), []string{"Releasing"}, []string{"Ready"}, d.Timeout(schema.TimeoutDelete))
+	releaseParams, scripts, err := getMachineReleaseParams(d, machine)
 	if err != nil {
 		return diag.FromErr(err)
 	}
 
+	// Release MAAS machine, and wait for it to be released
+	if err := releaseMachine(ctx, client, machine.SystemID, releaseParams, scripts, d.Timeout(schema.TimeoutDelete)); err != nil {
+		return diag.FromErr(err)
+	}
+
+	// Delete the kernel options of the machine
+	if d.Get("deploy_params.0.kernel_opts").(string) != "" {
+		if err := deleteMachineKernelOpts(client, machine.SystemID); err != nil {
+			return diag.FromErr(err)
+		}
+	}
+
+	// Decompose the VM composed for the instance
+	if err := decomposeInstanceMachine(client, d, machine.SystemID); err != nil {
+		return diag.FromErr(err)
+	}
+
 	return nil
 }
 
-func getMachinesAllocateParams(d *schema.ResourceData) *entity.MachineAllocateParams {
+// getAllocateParamsSchema returns the schema of the allocation constraints,
+// shared by the instances and the allocation candidates.
+func getAllocateParamsSchema(forceNew bool) map[string]*schema.Schema {
+	return map[string]*schema.Schema{
+		"agent_name": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			ForceNew:    forceNew,
+			Description: "The agent name set on the allocated MAAS machine, used to identify the machines allocated by a given agent.",
+		},
+		"arch": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			ForceNew:    forceNew,
+			Description: "The architecture of the MAAS machine to be allocated (e.g. `amd64/generic`).",
+		},
+		"comment": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			ForceNew:    forceNew,
+			Description: "The comment recorded in the machine event log when it is allocated.",
+		},
+		"cpu_speed": {
+			Type:        schema.TypeInt,
+			Optional:    true,
+			Default:     0,
+			ForceNew:    forceNew,
+			Description: "The minimum CPU speed (in MHz) used to allocate the MAAS machine.",
+		},
+		"devices": {
+			Type:        schema.TypeSet,
+			Optional:    true,
+			ForceNew:    forceNew,
+			Description: "A set of device filters that the MAAS machine to be allocated must match, in the `key=value` syntax (e.g. `vendor_id=10de`). Supported keys are: `vendor_id`, `product_id`, `vendor_name`, `product_name`, `commissioning_driver`.",
+			Elem: &schema.Schema{
+				Type: schema.TypeString,
+			},
+		},
+		"fabric_classes": {
+			Type:        schema.TypeSet,
+			Optional:    true,
+			ForceNew:    forceNew,
+			Description: "A set of fabric classes the MAAS machine to be allocated must be connected to.",
+			Elem: &schema.Schema{
+				Type: schema.TypeString,
+			},
+		},
+		"fabrics": {
+			Type:        schema.TypeSet,
+			Optional:    true,
+			ForceNew:    forceNew,
+			Description: "A set of fabrics the MAAS machine to be allocated must be connected to.",
+			Elem: &schema.Schema{
+				Type: schema.TypeString,
+			},
+		},
+		"hostname": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			ForceNew:    forceNew,
+			Description: "The hostname of the MAAS machine to be allocated.",
+		},
+		"interfaces": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			ForceNew:    forceNew,
+			Description: "The network interface constraints used to allocate the MAAS machine, in the MAAS label syntax: a semicolon separated list of `label:key=value,...` (e.g. `eth_storage:space=storage;eth_pub:space=public`). The labels can be used by the `network_interfaces` blocks, and the network interfaces matching each label are reported by `interface_matches`.",
+		},
+		"min_cpu_count": {
+			Type:        schema.TypeInt,
+			Optional:    true,
+			Default:     0,
+			ForceNew:    forceNew,
+			Description: "The minimum number of cores used to allocate the MAAS machine.",
+		},
+		"min_memory": {
+			Type:        schema.TypeInt,
+			Optional:    true,
+			Default:     0,
+			ForceNew:    forceNew,
+			Description: "The minimum RAM memory size (in MB) used to allocate the MAAS machine.",
+		},
+		"not_in_pool": {
+			Type:        schema.TypeSet,
+			Optional:    true,
+			ForceNew:    forceNew,
+			Description: "A set of pool names the MAAS machine to be allocated must not be in. It conflicts with `pool`.",
+			Elem: &schema.Schema{
+				Type: schema.TypeString,
+			},
+		},
+		"not_in_zone": {
+			Type:        schema.TypeSet,
+			Optional:    true,
+			ForceNew:    forceNew,
+			Description: "A set of zone names the MAAS machine to be allocated must not be in. It conflicts with `zone`.",
+			Elem: &schema.Schema{
+				Type: schema.TypeString,
+			},
+		},
+		"not_spaces": {
+			Type:        schema.TypeSet,
+			Optional:    true,
+			ForceNew:    forceNew,
+			Description: "A set of spaces the MAAS machine to be allocated must not be connected to.",
+			Elem: &schema.Schema{
+				Type: schema.TypeString,
+			},
+		},
+		"not_subnets": {
+			Type:        schema.TypeSet,
+			Optional:    true,
+			ForceNew:    forceNew,
+			Description: "A set of subnets the MAAS machine to be allocated must not be connected to. The subnets can be given by CIDR, ID, name, or with the MAAS subnet specifiers (e.g. `vlan:10`).",
+			Elem: &schema.Schema{
+				Type: schema.TypeString,
+			},
+		},
+		"not_tags": {
+			Type:        schema.TypeSet,
+			Optional:    true,
+			ForceNew:    forceNew,
+			Description: "A set of tag names that must not be assigned on the MAAS machine to be allocated.",
+			Elem: &schema.Schema{
+				Type: schema.TypeString,
+			},
+		},
+		"pod": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			ForceNew:    forceNew,
+			Description: "The VM host name used to allocate the MAAS machine. Only the VMs of the VM host are matched.",
+		},
+		"pod_type": {
+			Type:             schema.TypeString,
+			Optional:         true,
+			ForceNew:         forceNew,
+			ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice([]string{"lxd", "virsh"}, false)),
+			Description:      "The VM host type (`lxd` or `virsh`) used to allocate the MAAS machine. Only the VMs of the VM hosts of this type are matched.",
+		},
+		"pool": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			ForceNew:    forceNew,
+			Description: "The pool name of the MAAS machine to be allocated.",
+		},
+		"spaces": {
+			Type:        schema.TypeSet,
+			Optional:    true,
+			ForceNew:    forceNew,
+			Description: "A set of spaces the MAAS machine to be allocated must be connected to.",
+			Elem: &schema.Schema{
+				Type: schema.TypeString,
+			},
+		},
+		"storage": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			ForceNew:    forceNew,
+			Description: "The storage constraints used to allocate the MAAS machine, in the MAAS label syntax: a comma separated list of `label:size(tag,...)`, where the size is in GB and the tags are optional (e.g. `root:500(ssd),data:2000,data:2000`). The first constraint is matched by the root disk. The block devices matching each label are reported by `storage_matches`.",
+		},
+		"system_id": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			ForceNew:    forceNew,
+			Description: "The system_id of the MAAS machine to be allocated.",
+		},
+		"subnets": {
+			Type:        schema.TypeSet,
+			Optional:    true,
+			ForceNew:    forceNew,
+			Description: "A set of subnets the MAAS machine to be allocated must be connected to. The subnets can be given by CIDR, ID, name, or with the MAAS subnet specifiers (e.g. `vlan:10`).",
+			Elem: &schema.Schema{
+				Type: schema.TypeString,
+			},
+		},
+		"tags": {
+			Type:        schema.TypeSet,
+			Optional:    true,
+			ForceNew:    forceNew,
+			Description: "A set of tag names that must be assigned on the MAAS machine to be allocated.",
+			Elem: &schema.Schema{
+				Type: schema.TypeString,
+			},
+		},
+		"zone": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			ForceNew:    forceNew,
+			Description: "The zone name of the MAAS machine to be allocated.",
+		},
+	}
+}
+
+// machineAllocateParams adds the allocation constraints not supported by
+// gomaasclient.
+type machineAllocateParams struct {
+	entity.MachineAllocateParams
+	Devices  []string `url:"devices,omitempty"`
+	NotID    []string `url:"not_id,omitempty"`
+	CPUSpeed int      `url:"cpu_speed,omitempty"`
+}
+
+func getMachinesAllocateParams(d *schema.ResourceData) *machineAllocateParams {
 	if p, ok := d.GetOk("allocate_params"); ok {
 		allocateParamsData := p.([]interface{})
 		if allocateParamsData[0] != nil {
-			allocateParams := allocateParamsData[0].(map[string]interface{})
-			return &entity.MachineAllocateParams{
-				CPUCount: allocateParams["min_cpu_count"].(int),
-				Mem:      int64(allocateParams["min_memory"].(int)),
-				Name:     allocateParams["hostname"].(string),
-				Zone:     allocateParams["zone"].(string),
-				Pool:     allocateParams["pool"].(string),
-				SystemID: allocateParams["system_id"].(string),
-				Tags:     convertToStringSlice(allocateParams["tags"].(*schema.Set).List()),
-			}
+			return getMachinesAllocateParamsFromMap(allocateParamsData[0].(map[string]interface{}))
 		}
 	}
-	return &entity.MachineAllocateParams{}
+	return &machineAllocateParams{}
 }
 
-func getMachineDeployParams(d *schema.ResourceData) *entity.MachineDeployParams {
-	if p, ok := d.GetOk("deploy_params"); ok {
-		deployParamsData := p.([]interface{})
-		if deployParamsData[0] != nil {
-			deployParams := deployParamsData[0].(map[string]interface{})
-			return &entity.MachineDeployParams{
-				DistroSeries:    deployParams["distro_series"].(string),
-				EnableHwSync:    deployParams["enable_hw_sync"].(bool),
-				EphemeralDeploy: deployParams["ephemeral"].(bool),
-				HWEKernel:       deployParams["hwe_kernel"].(string),
-				UserData:        base64Encode([]byte(deployParams["user_data"].(string))),
+func getMachinesAllocateParamsFromMap(allocateParams map[string]interface{}) *machineAllocateParams {
+	getSet := func(key string) []string {
+		return convertToStringSlice(allocateParams[key].(*schema.Set).List())
+	}
+	params := &machineAllocateParams{
+		MachineAllocateParams: entity.MachineAllocateParams{
+			AgentName:     allocateParams["agent_name"].(string),
+			Arch:          allocateParams["arch"].(string),
+			Comment:       allocateParams["comment"].(string),
+			CPUCount:      allocateParams["min_cpu_count"].(int),
+			Mem:           int64(allocateParams["min_memory"].(int)),
+			Name:          allocateParams["hostname"].(string),
+			Zone:          allocateParams["zone"].(string),
+			NotInZone:     getSet("not_in_zone"),
+			Pool:          allocateParams["pool"].(string),
+			NotInPool:     getSet("not_in_pool"),
+			SystemID:      allocateParams["system_id"].(string),
+			Tags:          getSet("tags"),
+			NotTags:       getSet("not_tags"),
+			Subnets:       getSet("subnets"),
+			NotSubnets:    getSet("not_subnets"),
+			Fabrics:       getSet("fabrics"),
+			FabricClasses: getSet("fabric_classes"),
+			Interfaces:    allocateParams["interfaces"].(string),
+			VMHost:        allocateParams["pod"].(string),
+			VMHostType:    allocateParams["pod_type"].(string),
+		},
+		Devices:  getSet("devices"),
+		CPUSpeed: allocateParams["cpu_speed"].(int),
+	}
+	// MAAS matches the spaces with the subnet specifiers
+	for _, space := range getSet("spaces") {
+		params.Subnets = append(params.Subnets, "space:"+space)
+	}
+	for _, space := range getSet("not_spaces") {
+		params.NotSubnets = append(params.NotSubnets, "space:"+space)
+	}
+	// MAAS expects all the storage constraints in a single value
+	if storage := allocateParams["storage"].(string); storage != "" {
+		params.Storage = []string{storage}
+	}
+	return params
+}
+
+// resourceInstanceCustomizeDiff replaces the instance when it cannot be
+// updated in place, and rejects the network interfaces that are not
+// identified exactly once, the deploy options that are not supported by MAAS,
+// and the allocation constraints that cannot be matched by any machine.
+func resourceInstanceCustomizeDiff(ctx context.Context, d *schema.ResourceDiff, meta interface{}) error {
+	// Replace the instance when the deploy params change, unless the machine
+	// is redeployed in place
+	if d.Id() != "" && !d.Get("redeploy_on_change").(bool) {
+		for k, v := range getDeployParamsSchema() {
+			key := "deploy_params.0." + k
+			if !d.HasChange(key) {
+				continue
+			}
+			if err := d.ForceNew(key); err != nil {
+				return err
+			}
+			// The list blocks only replace the instance on the count changes
+			elem, ok := v.Elem.(*schema.Resource)
+			if !ok {
+				continue
+			}
+			for i := 0; i < d.Get(key+".#").(int); i++ {
+				for subKey := range elem.Schema {
+					elemKey := fmt.Sprintf("%s.%d.%s", key, i, subKey)
+					if d.HasChange(elemKey) {
+						if err := d.ForceNew(elemKey); err != nil {
+							return err
+						}
+					}
+				}
 			}
 		}
 	}
-	return &entity.MachineDeployParams{}
-}
 
-func configureInstanceNetworkInterfaces(client *client.Client, d *schema.ResourceData, machine *entity.Machine) error {
-	for _, networkInterface := range d.Get("network_interfaces").(*schema.Set).List() {
-		n := networkInterface.(map[string]interface{})
-		// Find the machine network interface
-		name := n["name"].(string)
-		nic, err := getNetworkInterface(client, machine.SystemID, name)
-		if err != nil {
+	if d.Get("compose_if_needed").(bool) && d.Get("allocate_params.0.pod").(string) == "" && d.Get("allocate_params.0.pod_type").(string) == "" {
+		return fmt.Errorf("compose_if_needed: 'allocate_params.pod' or 'allocate_params.pod_type' must be set")
+	}
+
+	// The network interfaces are checked once they're known, e.g. a subnet CIDR
+	// can refer to a subnet created by the same apply
+	networkInterfacesKnown := d.NewValueKnown("network_interfaces")
+	if config := d.GetRawConfig(); !config.IsNull() {
+		networkInterfacesKnown = config.GetAttr("network_interfaces").IsWhollyKnown()
+	}
+	if networkInterfacesKnown {
+		if err := validateInstanceNetworkInterfaces(d.Get("network_interfaces").(*schema.Set).List()); err != nil {
 			return err
 		}
-		// Validate the given network configs
-		subnetCIDR := n["subnet_cidr"].(string)
-		ipAddress := n["ip_address"].(string)
-		if subnetCIDR == "" {
-			if ipAddress != "" {
-				return fmt.Errorf("network interface (%s): 'subnet_cidr' is required when 'ip_address' is set", name)
-			}
-			// Clear existing network interface links
-			// This will leave the network interface disconnected
-			if _, err := client.NetworkInterface.Disconnect(machine.SystemID, nic.ID); err != nil {
+	}
+
+	// Validate the deploy options against MAAS, before the machine is created
+	// or redeployed
+	if meta != nil && (d.Id() == "" || d.HasChange("deploy_params")) && d.NewValueKnown("deploy_params") {
+		if p := d.Get("deploy_params").([]interface{}); len(p) > 0 && p[0] != nil {
+			if err := validateDeployParams(meta.(*client.Client), p[0].(map[string]interface{})); err != nil {
 				return err
 			}
-			continue
 		}
-		// Find the subnet
-		subnet, err := getSubnet(client, subnetCIDR)
-		if err != nil {
-			return err
+	}
+
+	p := d.Get("allocate_params").([]interface{})
+	if len(p) == 0 || p[0] == nil {
+		return nil
+	}
+	allocateParams := p[0].(map[string]interface{})
+
+	if err := validateAllocateParams(allocateParams); err != nil {
+		return fmt.Errorf("allocate_params: %w", err)
+	}
+
+	return nil
+}
+
+// validateAllocateParams rejects the allocation constraints that cannot be
+// matched by any machine, e.g. a pool that is also excluded.
+func validateAllocateParams(allocateParams map[string]interface{}) error {
+	conflicts := []struct {
+		key    string
+		notKey string
+	}{
+		{"pool", "not_in_pool"},
+		{"zone", "not_in_zone"},
+		{"tags", "not_tags"},
+		{"subnets", "not_subnets"},
+		{"spaces", "not_spaces"},
+	}
+	for _, c := range conflicts {
+		var values []interface{}
+		switch v := allocateParams[c.key].(type) {
+		case string:
+			values = []interface{}{v}
+		case *schema.Set:
+			values = v.List()
 		}
-		// Clear existing network interface links
-		if _, err := client.NetworkInterface.Disconnect(machine.SystemID, nic.ID); err != nil {
+		notValues := allocateParams[c.notKey].(*schema.Set)
+		for _, v := range values {
+			if notValues.Contains(v) {
+				return fmt.Errorf("%q is set in both '%s' and '%s'", v, c.key, c.notKey)
+			}
+		}
+	}
+
+	return nil
+}
+
+// machineConstraintsByType holds the machine objects matched by the labels of
+// the allocation constraints.
+type machineConstraintsByType struct {
+	Interfaces map[string][]interface{} `json:"interfaces,omitempty"`
+	Storage    map[string][]interface{} `json:"storage,omitempty"`
+}
+
+// allocateMachine allocates a machine. The constraints matched by the
+// allocation are dropped by gomaasclient, so the machine is allocated with
+// the MAAS API client directly.
+func allocateMachine(client *client.Client, params *machineAllocateParams) (*entity.Machine, *machineConstraintsByType, error) {
+	apiClient, err := getAPIClient(client)
+	if err != nil {
+		return nil, nil, err
+	}
+	qsp, err := query.Values(params)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	machine := new(entity.Machine)
+	constraints := struct {
+		ConstraintsByType machineConstraintsByType `json:"constraints_by_type"`
+	}{}
+	err = apiClient.GetSubObject("machines").Post("allocate", qsp, func(data []byte) error {
+		if err := json.Unmarshal(data, machine); err != nil {
 			return err
 		}
-		// Create new network interface link
-		mode := "AUTO"
-		if ipAddress != "" {
-			mode = "STATIC"
+		return json.Unmarshal(data, &constraints)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return machine, &constraints.ConstraintsByType, nil
+}
+
+func getStorageMatches(machine *entity.Machine, storageConstraints map[string][]interface{}) []map[string]interface{} {
+	blockDevices := map[string]string{}
+	for _, blockDevice := range machine.BlockDeviceSet {
+		blockDevices[fmt.Sprint(blockDevice.ID)] = blockDevice.Name
+	}
+	// Partitions are not block devices, their IDs are kept
+	return getConstraintMatches(blockDevices, storageConstraints, "block_devices")
+}
+
+func getInterfaceMatches(machine *entity.Machine, interfaceConstraints map[string][]interface{}) []map[string]interface{} {
+	return getConstraintMatches(getMachineNetworkInterfaceNames(machine), interfaceConstraints, "network_interfaces")
+}
+
+func getMachineNetworkInterfaceNames(machine *entity.Machine) map[string]string {
+	networkInterfaces := map[string]string{}
+	for _, networkInterface := range machine.InterfaceSet {
+		networkInterfaces[fmt.Sprint(networkInterface.ID)] = networkInterface.Name
+	}
+	return networkInterfaces
+}
+
+// getConstraintMatches returns the names of the objects matched by each label
+// of the allocation constraints, sorted by label. The IDs of the unknown
+// objects are kept.
+func getConstraintMatches(names map[string]string, constraints map[string][]interface{}, key string) []map[string]interface{} {
+	labels := make([]string, 0, len(constraints))
+	for label := range constraints {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	matches := make([]map[string]interface{}, len(labels))
+	for i, label := range labels {
+		matchNames := make([]string, len(constraints[label]))
+		for j, id := range constraints[label] {
+			name, ok := names[fmt.Sprint(id)]
+			if !ok {
+				name = fmt.Sprint(id)
+			}
+			matchNames[j] = name
+		}
+		matches[i] = map[string]interface{}{
+			"label": label,
+			key:     matchNames,
 		}
-		params := entity.NetworkInterfaceLinkParams{
-			Mode:      mode,
-			Subnet:    subnet.ID,
-			IPAddress: ipAddress,
+	}
+	return matches
+}
+
+// setMachineStorageLayout sets the storage layout of the allocated machine.
+// The operation is not supported by gomaasclient, so it's done with the MAAS
+// API client directly.
+func setMachineStorageLayout(client *client.Client, systemID string, storageLayout map[string]interface{}) error {
+	apiClient, err := getAPIClient(client)
+	if err != nil {
+		return err
+	}
+
+	qsp := url.Values{}
+	qsp.Set("storage_layout", storageLayout["layout"].(string))
+	for _, k := range []string{"boot_size", "root_device", "root_size", "vg_name", "lv_name", "lv_size", "cache_device", "cache_mode", "cache_size"} {
+		if v := storageLayout[k].(string); v != "" {
+			qsp.Set(k, v)
 		}
-		if _, err = client.NetworkInterface.LinkSubnet(machine.SystemID, nic.ID, &params); err != nil {
-			return err
+	}
+	if storageLayout["cache_no_part"].(bool) {
+		qsp.Set("cache_no_part", "true")
+	}
+
+	return apiClient.GetSubObject("machines").GetSubObject(systemID).Post("set_storage_layout", qsp, func(data []byte) error { return nil })
+}
+
+func getMachineDeployParams(d *schema.ResourceData) (*machineDeployParams, error) {
+	if p, ok := d.GetOk("deploy_params"); ok {
+		deployParamsData := p.([]interface{})
+		if deployParamsData[0] != nil {
+			deployParams := deployParamsData[0].(map[string]interface{})
+			userData, err := getDeployUserData(deployParams)
+			if err != nil {
+				return nil, err
+			}
+			return &machineDeployParams{
+				MachineDeployParams: entity.MachineDeployParams{
+					BridgeAll:       deployParams["bridge_all"].(bool),
+					BridgeFD:        deployParams["bridge_fd"].(int),
+					BridgeSTP:       deployParams["bridge_stp"].(bool),
+					DistroSeries:    deployParams["distro_series"].(string),
+					EnableHwSync:    deployParams["enable_hw_sync"].(bool),
+					EphemeralDeploy: deployParams["ephemeral"].(bool),
+					HWEKernel:       deployParams["hwe_kernel"].(string),
+					InstallKVM:      deployParams["install_kvm"].(bool),
+					RegisterVMHost:  deployParams["register_vmhost"].(bool),
+					UserData:        userData,
+				},
+				OSystem:               deployParams["osystem"].(string),
+				BridgeType:            deployParams["bridge_type"].(string),
+				VCenterRegistration:   deployParams["vcenter_registration"].(bool),
+				EnableKernelCrashDump: deployParams["enable_kernel_crash_dump"].(bool),
+			}, nil
 		}
 	}
-	return nil
+	return &machineDeployParams{}, nil
+}
+
+// getMachineReleaseParams returns the params, and the release scripts, used
+// to release the machine of the instance.
+func getMachineReleaseParams(d *schema.ResourceData, machine *entity.Machine) (*entity.MachineReleaseParams, []string, error) {
+	comment := "Released by Terraform"
+	releaseParams := &entity.MachineReleaseParams{}
+	var scripts []string
+	if p, ok := d.GetOk("release_params"); ok {
+		releaseParamsData := p.([]interface{})
+		if releaseParamsData[0] != nil {
+			params := releaseParamsData[0].(map[string]interface{})
+			comment = params["comment"].(string)
+			releaseParams.Force = params["force"].(bool)
+			releaseParams.SecureErase = params["secure_erase"].(bool)
+			releaseParams.QuickErase = params["quick_erase"].(bool)
+			releaseParams.Erase = params["erase"].(bool) || releaseParams.SecureErase || releaseParams.QuickErase
+			scripts = convertToStringSlice(params["scripts"])
+		}
+	}
+
+	tmpl, err := template.New("comment").Parse(comment)
+	if err != nil {
+		return nil, nil, err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, machine); err != nil {
+		return nil, nil, fmt.Errorf("failed to render the release comment: %w", err)
+	}
+	releaseParams.Comment = b.String()
+
+	return releaseParams, scripts, nil
 }
@@ -0,0 +1,665 @@
+package maas
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/canonical/gomaasclient/client"
+	"github.com/canonical/gomaasclient/entity"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+)
+
+func resourceMaasInstanceGroup() *schema.Resource {
+	return &schema.Resource{
+		Description:   "Provides a resource to deploy a group of identical MAAS machines concurrently. The members are allocated up front, deployed all at once, and their deployment is polled with a single request.",
+		CreateContext: resourceInstanceGroupCreate,
+		ReadContext:   resourceInstanceGroupRead,
+		UpdateContext: resourceInstanceGroupUpdate,
+		DeleteContext: resourceInstanceGroupDelete,
+		CustomizeDiff: resourceInstanceGroupCustomizeDiff,
+		UseJSONNumber: true,
+
+		Schema: map[string]*schema.Schema{
+			"allocate_params": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				MaxItems:    1,
+				Description: "Nested argument with the constraints used to allocate the members. Changes to this argument replace the members, `rolling_batch_size` at a time. Defined below.",
+				Elem: &schema.Resource{
+					Schema: getAllocateParamsSchema(false),
+				},
+			},
+			"deploy_params": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				MaxItems:    1,
+				Description: "Nested argument with the config used to deploy the members. Changes to this argument replace the members, `rolling_batch_size` at a time. Defined below.",
+				Elem: &schema.Resource{
+					Schema: getDeployParamsSchema(),
+				},
+			},
+			"ids": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "The system IDs of the members, sorted by index.",
+			},
+			"member_overrides": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "Overrides the group configuration for a single member. Changes to an override replace its member. Defined below.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"distro_series": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "The distro series used to deploy the member, instead of `deploy_params.distro_series`.",
+						},
+						"hostname": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "The hostname set on the member before it's deployed.",
+						},
+						"index": {
+							Type:             schema.TypeInt,
+							Required:         true,
+							ValidateDiagFunc: validation.ToDiagFunc(validation.IntAtLeast(0)),
+							Description:      "The index of the member, from `0` to `size - 1`.",
+						},
+						"system_id": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "The system ID of the machine allocated for the member, instead of matching `allocate_params`.",
+						},
+						"user_data": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "The cloud-init user data used to deploy the member, instead of the `deploy_params` user data (`user_data`, `user_data_base64` or `cloud_init_part`).",
+						},
+					},
+				},
+			},
+			"members": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "The deployed members, sorted by index. Defined below.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"fqdn": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The FQDN of the member.",
+						},
+						"hostname": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The hostname of the member.",
+						},
+						"id": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The system ID of the member.",
+						},
+						"index": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "The index of the member.",
+						},
+						"ip_addresses": {
+							Type:        schema.TypeList,
+							Computed:    true,
+							Elem:        &schema.Schema{Type: schema.TypeString},
+							Description: "The IP addresses of the member.",
+						},
+						"status": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The status of the member.",
+						},
+					},
+				},
+			},
+			"min_healthy": {
+				Type:             schema.TypeInt,
+				Optional:         true,
+				ValidateDiagFunc: validation.ToDiagFunc(validation.IntAtLeast(0)),
+				Description:      "The minimum number of members that must be deployed for an update of the group to succeed. When the group is created, a warning is reported instead, so the deployed members are kept. The members that fail to be deployed are released, and they're deployed again by the next apply. Defaults to `size`.",
+			},
+			"name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The name of the instance group. It's used as the ID of the resource.",
+			},
+			"rolling_batch_size": {
+				Type:             schema.TypeInt,
+				Optional:         true,
+				Default:          1,
+				ValidateDiagFunc: validation.ToDiagFunc(validation.IntAtLeast(1)),
+				Description:      "The number of members replaced at a time, when the allocation or deploy params change. The new machines are deployed before the old ones are released. Defaults to `1`.",
+			},
+			"size": {
+				Type:             schema.TypeInt,
+				Required:         true,
+				ValidateDiagFunc: validation.ToDiagFunc(validation.IntAtLeast(1)),
+				Description:      "The number of members of the group. The new members are deployed, and the members with the highest indexes are released, in place.",
+			},
+		},
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(60 * time.Minute),
+			Update: schema.DefaultTimeout(60 * time.Minute),
+			Delete: schema.DefaultTimeout(30 * time.Minute),
+		},
+	}
+}
+
+// instanceGroupMember is a deployed member of an instance group.
+type instanceGroupMember struct {
+	Index    int
+	SystemID string
+}
+
+func resourceInstanceGroupCreate(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*client.Client)
+
+	d.SetId(d.Get("name").(string))
+
+	indexes := make([]int, d.Get("size").(int))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	members, diags := deployInstanceGroupMembers(ctx, client, d, indexes, d.Timeout(schema.TimeoutCreate))
+	if err := setInstanceGroupMembers(d, members); err != nil {
+		return append(diags, diag.FromErr(err)...)
+	}
+	if diags.HasError() {
+		return diags
+	}
+	// An error would taint the group, and replace the deployed members. The
+	// missing members are deployed by the next apply instead.
+	for _, health := range checkInstanceGroupHealth(d, members) {
+		health.Severity = diag.Warning
+		diags = append(diags, health)
+	}
+
+	return append(diags, resourceInstanceGroupRead(ctx, d, meta)...)
+}
+
+func resourceInstanceGroupRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*client.Client)
+
+	members := getInstanceGroupMembers(d)
+	machines := map[string]entity.Machine{}
+	if len(members) > 0 {
+		systemIDs := make([]string, len(members))
+		for i, member := range members {
+			systemIDs[i] = member.SystemID
+		}
+		result, err := client.Machines.Get(&entity.MachinesParams{ID: systemIDs})
+		if err != nil {
+			return diag.FromErr(err)
+		}
+		for _, machine := range result {
+			machines[machine.SystemID] = machine
+		}
+	}
+
+	// The members released outside of Terraform are removed, so they're
+	// deployed again by the next apply
+	ids := []string{}
+	membersState := []map[string]interface{}{}
+	for _, member := range members {
+		machine, ok := machines[member.SystemID]
+		if !ok || machine.StatusName == "Ready" {
+			log.Printf("[WARN] Instance group (%s) member %d (%s) was released, removing it from state\n", d.Id(), member.Index, member.SystemID)
+			continue
+		}
+		ipAddresses := make([]string, len(machine.IPAddresses))
+		for i, ip := range machine.IPAddresses {
+			ipAddresses[i] = ip.String()
+		}
+		ids = append(ids, machine.SystemID)
+		membersState = append(membersState, map[string]interface{}{
+			"fqdn":         machine.FQDN,
+			"hostname":     machine.Hostname,
+			"id":           machine.SystemID,
+			"index":        member.Index,
+			"ip_addresses": ipAddresses,
+			"status":       machine.StatusName,
+		})
+	}
+
+	tfState := map[string]interface{}{
+		"ids":     ids,
+		"members": membersState,
+	}
+	if err := setTerraformState(d, tfState); err != nil {
+		return diag.FromErr(err)
+	}
+
+	return nil
+}
+
+func resourceInstanceGroupUpdate(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*client.Client)
+
+	var diags diag.Diagnostics
+	timeout := d.Timeout(schema.TimeoutUpdate)
+	size := d.Get("size").(int)
+	members := map[int]string{}
+	for _, member := range getInstanceGroupMembers(d) {
+		members[member.Index] = member.SystemID
+	}
+
+	// Release the members above the new size
+	var removed []string
+	for index, systemID := range members {
+		if index >= size {
+			removed = append(removed, systemID)
+			delete(members, index)
+		}
+	}
+	if err := releaseInstanceGroupMachines(ctx, client, d, removed, timeout); err != nil {
+		return diag.FromErr(err)
+	}
+	if err := setInstanceGroupMembers(d, getSortedInstanceGroupMembers(members)); err != nil {
+		return diag.FromErr(err)
+	}
+
+	// Replace the members whose config changed, one batch at a time. The new
+	// machines are deployed before the old ones are released, and the rolling
+	// replacement stops at the first failed batch.
+	var replaced []int
+	if d.HasChanges("allocate_params", "deploy_params") {
+		for index := range members {
+			replaced = append(replaced, index)
+		}
+	} else if d.HasChange("member_overrides") {
+		oldOverrides, newOverrides := d.GetChange("member_overrides")
+		for _, index := range getChangedInstanceGroupOverrides(oldOverrides.([]interface{}), newOverrides.([]interface{})) {
+			if _, ok := members[index]; ok {
+				replaced = append(replaced, index)
+			}
+		}
+	}
+	sort.Ints(replaced)
+	for _, batch := range getInstanceGroupBatches(replaced, d.Get("rolling_batch_size").(int)) {
+		deployed, batchDiags := deployInstanceGroupMembers(ctx, client, d, batch, timeout)
+		diags = append(diags, batchDiags...)
+		var old []string
+		for _, member := range deployed {
+			old = append(old, members[member.Index])
+			members[member.Index] = member.SystemID
+		}
+		if err := setInstanceGroupMembers(d, getSortedInstanceGroupMembers(members)); err != nil {
+			return append(diags, diag.FromErr(err)...)
+		}
+		if err := releaseInstanceGroupMachines(ctx, client, d, old, timeout); err != nil {
+			return append(diags, diag.FromErr(err)...)
+		}
+		if batchDiags.HasError() {
+			return diags
+		}
+		if len(deployed) < len(batch) {
+			return append(diags, diag.Errorf("instance group (%s) rolling replacement stopped, %d of %d members of the batch failed to be deployed", d.Id(), len(batch)-len(deployed), len(batch))...)
+		}
+	}
+
+	// Deploy the missing members
+	var missing []int
+	for index := 0; index < size; index++ {
+		if _, ok := members[index]; !ok {
+			missing = append(missing, index)
+		}
+	}
+	if len(missing) > 0 {
+		deployed, deployDiags := deployInstanceGroupMembers(ctx, client, d, missing, timeout)
+		diags = append(diags, deployDiags...)
+		for _, member := range deployed {
+			members[member.Index] = member.SystemID
+		}
+		if err := setInstanceGroupMembers(d, getSortedInstanceGroupMembers(members)); err != nil {
+			return append(diags, diag.FromErr(err)...)
+		}
+	}
+
+	diags = append(diags, checkInstanceGroupHealth(d, getSortedInstanceGroupMembers(members))...)
+	if diags.HasError() {
+		return diags
+	}
+
+	return append(diags, resourceInstanceGroupRead(ctx, d, meta)...)
+}
+
+func resourceInstanceGroupDelete(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*client.Client)
+
+	var systemIDs []string
+	for _, member := range getInstanceGroupMembers(d) {
+		systemIDs = append(systemIDs, member.SystemID)
+	}
+	if err := releaseInstanceGroupMachines(ctx, client, d, systemIDs, d.Timeout(schema.TimeoutDelete)); err != nil {
+		return diag.FromErr(err)
+	}
+
+	return nil
+}
+
+func resourceInstanceGroupCustomizeDiff(ctx context.Context, d *schema.ResourceDiff, meta interface{}) error {
+	size := d.Get("size").(int)
+	if minHealthy := d.Get("min_healthy").(int); minHealthy > size {
+		return fmt.Errorf("min_healthy (%d) cannot be greater than size (%d)", minHealthy, size)
+	}
+	overrides := map[int]bool{}
+	for _, override := range d.Get("member_overrides").([]interface{}) {
+		index := override.(map[string]interface{})["index"].(int)
+		if index >= size {
+			return fmt.Errorf("member_overrides: index (%d) must be lower than size (%d)", index, size)
+		}
+		if overrides[index] {
+			return fmt.Errorf("member_overrides: index (%d) is overridden more than once", index)
+		}
+		overrides[index] = true
+	}
+	if p := d.Get("allocate_params").([]interface{}); len(p) > 0 && p[0] != nil {
+		if err := validateAllocateParams(p[0].(map[string]interface{})); err != nil {
+			return fmt.Errorf("allocate_params: %w", err)
+		}
+	}
+
+	// The members are replaced, released or deployed when the group changes,
+	// or when some members are missing
+	if d.Id() != "" && (d.HasChanges("allocate_params", "deploy_params", "member_overrides") || len(d.Get("members").([]interface{})) != size) {
+		if err := d.SetNewComputed("members"); err != nil {
+			return err
+		}
+		if err := d.SetNewComputed("ids"); err != nil {
+			return err
+		}
+	}
+
+	// Validate the deploy options against MAAS, before the members are created
+	// or replaced
+	if meta != nil && (d.Id() == "" || d.HasChange("deploy_params")) && d.NewValueKnown("deploy_params") {
+		if p := d.Get("deploy_params").([]interface{}); len(p) > 0 && p[0] != nil {
+			if err := validateDeployParams(meta.(*client.Client), p[0].(map[string]interface{})); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// deployInstanceGroupMembers deploys the members with the given indexes. When
+// the provider limits the parallel deployments, they're deployed in batches of
+// `max_parallel_deployments` members.
+func deployInstanceGroupMembers(ctx context.Context, client *client.Client, d *schema.ResourceData, indexes []int, timeout time.Duration) ([]instanceGroupMember, diag.Diagnostics) {
+	batchSize := getMaxParallelDeployments(client)
+	if batchSize == 0 {
+		batchSize = len(indexes)
+	}
+
+	var diags diag.Diagnostics
+	var deployed []instanceGroupMember
+	for _, batch := range getInstanceGroupBatches(indexes, batchSize) {
+		releaseSlots, err := acquireDeploymentSlots(ctx, client, len(batch), fmt.Sprintf("Deployment of instance group (%s) members %v", d.Id(), batch))
+		if err != nil {
+			return deployed, append(diags, diag.FromErr(err)...)
+		}
+		members, batchDiags := deployInstanceGroupMembersBatch(ctx, client, d, batch, timeout)
+		releaseSlots()
+		deployed = append(deployed, members...)
+		diags = append(diags, batchDiags...)
+		if batchDiags.HasError() {
+			break
+		}
+	}
+
+	return deployed, diags
+}
+
+// deployInstanceGroupMembersBatch allocates the members with the given
+// indexes, deploys them all at once, and waits for them with a single poll.
+// The members that cannot be allocated, or fail to be deployed, are released
+// and reported as warnings. When the wait fails, the members that are still
+// deploying are returned with the error, so they're kept in the state.
+func deployInstanceGroupMembersBatch(ctx context.Context, client *client.Client, d *schema.ResourceData, indexes []int, timeout time.Duration) ([]instanceGroupMember, diag.Diagnostics) {
+	var diags diag.Diagnostics
+	failed := func(index int, systemID string, err error) {
+		diags = append(diags, diag.Diagnostic{
+			Severity: diag.Warning,
+			Summary:  fmt.Sprintf("Instance group (%s) member %d failed to be deployed", d.Id(), index),
+			Detail:   fmt.Sprintf("Machine (%s): %s", systemID, err),
+		})
+	}
+
+	// Allocate and deploy the members
+	var members []instanceGroupMember
+	var released []string
+	for _, index := range indexes {
+		override := getInstanceGroupMemberOverride(d, index)
+		allocateParams := &machineAllocateParams{}
+		if p, ok := d.GetOk("allocate_params"); ok && p.([]interface{})[0] != nil {
+			allocateParams = getMachinesAllocateParamsFromMap(p.([]interface{})[0].(map[string]interface{}))
+		}
+		if systemID, ok := override["system_id"].(string); ok && systemID != "" {
+			allocateParams.SystemID = systemID
+		}
+		machine, _, err := allocateMachine(client, allocateParams)
+		if err != nil {
+			failed(index, allocateParams.SystemID, err)
+			continue
+		}
+		if err := deployInstanceGroupMember(client, d, machine.SystemID, override); err != nil {
+			failed(index, machine.SystemID, err)
+			released = append(released, machine.SystemID)
+			continue
+		}
+		members = append(members, instanceGroupMember{Index: index, SystemID: machine.SystemID})
+	}
+
+	// Wait for all the members to be deployed
+	var deployed []instanceGroupMember
+	if len(members) > 0 {
+		systemIDs := make([]string, len(members))
+		for i, member := range members {
+			systemIDs[i] = member.SystemID
+		}
+		machines, err := waitForMachinesStatus(ctx, client, systemIDs, []string{"Allocated", "Deploying"}, timeout)
+		if err != nil {
+			// Keep tracking the members, their deployment may still succeed
+			diags = append(diags, diag.FromErr(err)...)
+			if err := releaseInstanceGroupMachines(ctx, client, d, released, timeout); err != nil {
+				diags = append(diags, diag.FromErr(err)...)
+			}
+			return members, diags
+		}
+		for _, member := range members {
+			machine, ok := machines[member.SystemID]
+			if !ok {
+				failed(member.Index, member.SystemID, fmt.Errorf("machine not found"))
+				continue
+			}
+			if machine.StatusName != "Deployed" {
+				failed(member.Index, member.SystemID, fmt.Errorf("%s: %s", machine.StatusName, machine.StatusMessage))
+				released = append(released, member.SystemID)
+				continue
+			}
+			deployed = append(deployed, member)
+		}
+	}
+
+	// Release the failed members
+	if err := releaseInstanceGroupMachines(ctx, client, d, released, timeout); err != nil {
+		return deployed, append(diags, diag.FromErr(err)...)
+	}
+
+	return deployed, diags
+}
+
+// deployInstanceGroupMember configures and deploys the allocated machine of
+// a member, without waiting for it.
+func deployInstanceGroupMember(client *client.Client, d *schema.ResourceData, systemID string, override map[string]interface{}) error {
+	if hostname, ok := override["hostname"].(string); ok && hostname != "" {
+		if _, err := client.Machine.Update(systemID, &entity.MachineParams{Hostname: hostname}, map[string]interface{}{}); err != nil {
+			return err
+		}
+	}
+	if kernelOpts := d.Get("deploy_params.0.kernel_opts").(string); kernelOpts != "" {
+		if err := setMachineKernelOpts(client, systemID, kernelOpts); err != nil {
+			return err
+		}
+	}
+
+	deployParams, err := getMachineDeployParams(d)
+	if err != nil {
+		return err
+	}
+	if distroSeries, ok := override["distro_series"].(string); ok && distroSeries != "" {
+		deployParams.DistroSeries = distroSeries
+	}
+	if userData, ok := override["user_data"].(string); ok && userData != "" {
+		if deployParams.UserData, err = getDeployUserData(map[string]interface{}{"user_data": userData}); err != nil {
+			return err
+		}
+	}
+	_, err = deployMachine(client, systemID, deployParams)
+	return err
+}
+
+// releaseInstanceGroupMachines releases the given machines all at once, and
+// waits for them with a single poll.
+func releaseInstanceGroupMachines(ctx context.Context, client *client.Client, d *schema.ResourceData, systemIDs []string, timeout time.Duration) error {
+	if len(systemIDs) == 0 {
+		return nil
+	}
+	releaseParams := &entity.MachineReleaseParams{Comment: fmt.Sprintf("Released by Terraform from instance group (%s)", d.Id())}
+	for _, systemID := range systemIDs {
+		if _, err := client.Machine.Release(systemID, releaseParams); err != nil {
+			return err
+		}
+	}
+	machines, err := waitForMachinesStatus(ctx, client, systemIDs, []string{"Releasing", "Disk erasing"}, timeout)
+	if err != nil {
+		return err
+	}
+
+	var failures []string
+	for _, systemID := range systemIDs {
+		if machine, ok := machines[systemID]; ok && machine.StatusName != "Ready" {
+			failures = append(failures, fmt.Sprintf("%s (%s: %s)", machine.Hostname, machine.StatusName, machine.StatusMessage))
+			continue
+		}
+		if err := deleteMachineKernelOpts(client, systemID); err != nil {
+			return err
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("machines failed to be released: %s", strings.Join(failures, ", "))
+	}
+
+	return nil
+}
+
+// checkInstanceGroupHealth fails when less than `min_healthy` members are
+// deployed.
+func checkInstanceGroupHealth(d *schema.ResourceData, members []instanceGroupMember) diag.Diagnostics {
+	minHealthy := d.Get("size").(int)
+	if v, ok := d.GetOk("min_healthy"); ok {
+		minHealthy = v.(int)
+	}
+	if len(members) < minHealthy {
+		return diag.Errorf("instance group (%s) has %d healthy members, at least %d are required", d.Id(), len(members), minHealthy)
+	}
+	return nil
+}
+
+func getInstanceGroupMemberOverride(d *schema.ResourceData, index int) map[string]interface{} {
+	for _, override := range d.Get("member_overrides").([]interface{}) {
+		if o := override.(map[string]interface{}); o["index"].(int) == index {
+			return o
+		}
+	}
+	return map[string]interface{}{}
+}
+
+func getInstanceGroupMembers(d *schema.ResourceData) []instanceGroupMember {
+	var members []instanceGroupMember
+	for _, member := range d.Get("members").([]interface{}) {
+		m := member.(map[string]interface{})
+		members = append(members, instanceGroupMember{Index: m["index"].(int), SystemID: m["id"].(string)})
+	}
+	return members
+}
+
+func getSortedInstanceGroupMembers(members map[int]string) []instanceGroupMember {
+	result := make([]instanceGroupMember, 0, len(members))
+	for index, systemID := range members {
+		result = append(result, instanceGroupMember{Index: index, SystemID: systemID})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Index < result[j].Index
+	})
+	return result
+}
+
+// setInstanceGroupMembers saves the members, so they're tracked even if the
+// apply fails. Their details are set by the read.
+func setInstanceGroupMembers(d *schema.ResourceData, members []instanceGroupMember) error {
+	ids := make([]string, len(members))
+	membersState := make([]map[string]interface{}, len(members))
+	for i, member := range members {
+		ids[i] = member.SystemID
+		membersState[i] = map[string]interface{}{
+			"id":    member.SystemID,
+			"index": member.Index,
+		}
+	}
+	tfState := map[string]interface{}{
+		"ids":     ids,
+		"members": membersState,
+	}
+	return setTerraformState(d, tfState)
+}
+
+// getChangedInstanceGroupOverrides returns the indexes of the members whose
+// override changed.
+func getChangedInstanceGroupOverrides(oldOverrides []interface{}, newOverrides []interface{}) []int {
+	overrides := map[int][2]string{}
+	for i, list := range [][]interface{}{oldOverrides, newOverrides} {
+		for _, override := range list {
+			o := override.(map[string]interface{})
+			v := overrides[o["index"].(int)]
+			v[i] = fmt.Sprintf("%v %v %v %v", o["distro_series"], o["hostname"], o["system_id"], o["user_data"])
+			overrides[o["index"].(int)] = v
+		}
+	}
+	var changed []int
+	for index, v := range overrides {
+		if v[0] != v[1] {
+			changed = append(changed, index)
+		}
+	}
+	sort.Ints(changed)
+	return changed
+}
+
+// getInstanceGroupBatches splits the indexes in batches of the given size.
+func getInstanceGroupBatches(indexes []int, batchSize int) [][]int {
+	var batches [][]int
+	for start := 0; start < len(indexes); start += batchSize {
+		end := start + batchSize
+		if end > len(indexes) {
+			end = len(indexes)
+		}
+		batches = append(batches, indexes[start:end])
+	}
+	return batches
+}
@@ -0,0 +1,23 @@
+package maas
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetInstanceGroupBatches(t *testing.T) {
+	assert.Equal(t, [][]int{{0, 1}, {2, 3}, {4}}, getInstanceGroupBatches([]int{0, 1, 2, 3, 4}, 2))
+	assert.Equal(t, [][]int{{0, 1, 2}}, getInstanceGroupBatches([]int{0, 1, 2}, 5))
+	assert.Empty(t, getInstanceGroupBatches(nil, 1))
+}
+
+func TestGetChangedInstanceGroupOverrides(t *testing.T) {
+	override := func(index int, hostname string, userData string) map[string]interface{} {
+		return map[string]interface{}{"index": index, "distro_series": "", "hostname": hostname, "system_id": "", "user_data": userData}
+	}
+	oldOverrides := []interface{}{override(0, "node-0", ""), override(1, "node-1", ""), override(2, "node-2", "")}
+	newOverrides := []interface{}{override(2, "node-2", ""), override(1, "node-1", "#cloud-config"), override(3, "node-3", "")}
+
+	assert.Equal(t, []int{0, 1, 3}, getChangedInstanceGroupOverrides(oldOverrides, newOverrides))
+}
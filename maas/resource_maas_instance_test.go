@@ -0,0 +1,305 @@
+package maas
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/canonical/gomaasclient/client"
+	"github.com/canonical/gomaasclient/entity"
+	"github.com/google/go-querystring/query"
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetMachineReleaseParams(t *testing.T) {
+	machine := &entity.Machine{SystemID: "abc123", Hostname: "node1", FQDN: "node1.maas"}
+
+	testCases := []struct {
+		name          string
+		raw           map[string]interface{}
+		releaseParams *entity.MachineReleaseParams
+		scripts       []string
+	}{
+		{
+			name:          "no release_params",
+			raw:           map[string]interface{}{},
+			releaseParams: &entity.MachineReleaseParams{Comment: "Released by Terraform"},
+		},
+		{
+			name: "quick erase implies erase",
+			raw: map[string]interface{}{
+				"release_params": []interface{}{map[string]interface{}{"quick_erase": true, "force": true}},
+			},
+			releaseParams: &entity.MachineReleaseParams{Comment: "Released by Terraform", Erase: true, QuickErase: true, Force: true},
+		},
+		{
+			name: "comment template and scripts",
+			raw: map[string]interface{}{
+				"release_params": []interface{}{map[string]interface{}{
+					"comment": "{{ .Hostname }} ({{ .SystemID }}) released by Terraform",
+					"scripts": []interface{}{"wipe-disks"},
+				}},
+			},
+			releaseParams: &entity.MachineReleaseParams{Comment: "node1 (abc123) released by Terraform"},
+			scripts:       []string{"wipe-disks"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			d := schema.TestResourceDataRaw(t, resourceMaasInstance().Schema, testCase.raw)
+			releaseParams, scripts, err := getMachineReleaseParams(d, machine)
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.releaseParams, releaseParams)
+			assert.ElementsMatch(t, testCase.scripts, scripts)
+		})
+	}
+}
+
+func TestGetStorageMatches(t *testing.T) {
+	machine := &entity.Machine{
+		BlockDeviceSet: []entity.BlockDevice{
+			{ID: 10, Name: "sda"},
+			{ID: 11, Name: "sdb"},
+			{ID: 12, Name: "sdc"},
+		},
+	}
+	storageConstraints := map[string][]interface{}{
+		"root": {float64(10)},
+		"data": {float64(11), float64(12)},
+		"logs": {"partition:42"},
+	}
+
+	expected := []map[string]interface{}{
+		{"label": "data", "block_devices": []string{"sdb", "sdc"}},
+		{"label": "logs", "block_devices": []string{"partition:42"}},
+		{"label": "root", "block_devices": []string{"sda"}},
+	}
+	assert.Equal(t, expected, getStorageMatches(machine, storageConstraints))
+}
+
+func TestGetMachinesAllocateParams(t *testing.T) {
+	raw := map[string]interface{}{
+		"allocate_params": []interface{}{map[string]interface{}{
+			"arch":       "amd64/generic",
+			"cpu_speed":  2000,
+			"devices":    []interface{}{"vendor_id=10de"},
+			"pool":       "gpu",
+			"spaces":     []interface{}{"storage"},
+			"not_spaces": []interface{}{"public"},
+			"subnets":    []interface{}{"10.0.0.0/24"},
+			"storage":    "root:500(ssd),data:2000",
+			"pod_type":   "lxd",
+		}},
+	}
+	d := schema.TestResourceDataRaw(t, resourceMaasInstance().Schema, raw)
+
+	qsp, err := query.Values(getMachinesAllocateParams(d))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"amd64/generic"}, qsp["arch"])
+	assert.Equal(t, []string{"2000"}, qsp["cpu_speed"])
+	assert.Equal(t, []string{"vendor_id=10de"}, qsp["devices"])
+	assert.Equal(t, []string{"gpu"}, qsp["pool"])
+	assert.ElementsMatch(t, []string{"10.0.0.0/24", "space:storage"}, qsp["subnets"])
+	assert.Equal(t, []string{"space:public"}, qsp["not_subnets"])
+	assert.Equal(t, []string{"root:500(ssd),data:2000"}, qsp["storage"])
+	assert.Equal(t, []string{"lxd"}, qsp["pod_type"])
+}
+
+func TestUpdateMachineClearsDescription(t *testing.T) {
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Equal(t, "/api/2.0/machines/abc123/", r.URL.Path)
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			assert.NoError(t, r.ParseForm())
+		}
+		form = r.PostForm
+		fmt.Fprint(w, `{"system_id": "abc123", "resource_uri": "/MAAS/api/2.0/machines/abc123/"}`)
+	}))
+	defer server.Close()
+
+	c, err := client.GetClient(server.URL, "consumer:token:secret", "2.0")
+	assert.NoError(t, err)
+	d := schema.TestResourceDataRaw(t, resourceMaasInstance().Schema, map[string]interface{}{"hostname": "node1"})
+	assert.NoError(t, updateMachine(c, "abc123", getInstanceMachineParams(d)))
+
+	assert.Contains(t, form, "description")
+	assert.Equal(t, "", form.Get("description"))
+	assert.Equal(t, "node1", form.Get("hostname"))
+	assert.NotContains(t, form, "zone")
+}
+
+func TestComposeInstanceMachineWaitFailure(t *testing.T) {
+	var deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/2.0/pods/":
+			fmt.Fprint(w, `[{"id": 1, "name": "lxd-1", "type": "lxd"}]`)
+		case r.Method == http.MethodPost && r.URL.Path == "/api/2.0/pods/1/" && r.URL.Query().Get("op") == "compose":
+			fmt.Fprint(w, `{"system_id": "abc123", "hostname": "vm-1", "resource_uri": "/MAAS/api/2.0/machines/abc123/"}`)
+		case r.Method == http.MethodDelete && r.URL.Path == "/api/2.0/machines/abc123/":
+			deleted = append(deleted, "abc123")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	c, err := client.GetClient(server.URL, "consumer:token:secret", "2.0")
+	assert.NoError(t, err)
+	// The wait fails right away, as on a timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, _, err = composeInstanceMachine(ctx, c, &machineAllocateParams{MachineAllocateParams: entity.MachineAllocateParams{VMHostType: "lxd"}}, time.Minute)
+	assert.ErrorContains(t, err, "composed machine (vm-1) failed to be commissioned")
+	assert.Equal(t, []string{"abc123"}, deleted)
+}
+
+func TestResourceInstanceDeployParamsDiff(t *testing.T) {
+	state := &terraform.InstanceState{
+		ID: "abc123",
+		Attributes: map[string]string{
+			"id":                            "abc123",
+			"deploy_params.#":               "1",
+			"deploy_params.0.distro_series": "jammy",
+			"redeploy_on_change":            "false",
+		},
+	}
+
+	testCases := []struct {
+		name             string
+		redeployOnChange bool
+		requiresNew      bool
+	}{
+		{name: "replace", requiresNew: true},
+		{name: "redeploy", redeployOnChange: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			config := terraform.NewResourceConfigRaw(map[string]interface{}{
+				"deploy_params":      []interface{}{map[string]interface{}{"distro_series": "noble"}},
+				"redeploy_on_change": testCase.redeployOnChange,
+			})
+			diff, err := resourceMaasInstance().Diff(context.Background(), state, config, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.requiresNew, diff.RequiresNew())
+			assert.Equal(t, "noble", diff.Attributes["deploy_params.0.distro_series"].New)
+		})
+	}
+
+	state.Attributes["deploy_params.0.cloud_init_part.#"] = "1"
+	state.Attributes["deploy_params.0.cloud_init_part.0.content"] = "#cloud-config\n"
+	state.Attributes["deploy_params.0.cloud_init_part.0.content_type"] = "text/cloud-config"
+	config := terraform.NewResourceConfigRaw(map[string]interface{}{
+		"deploy_params": []interface{}{map[string]interface{}{
+			"distro_series":   "jammy",
+			"cloud_init_part": []interface{}{map[string]interface{}{"content": "#cloud-config\npackages: [jq]\n"}},
+		}},
+	})
+	diff, err := resourceMaasInstance().Diff(context.Background(), state, config, nil)
+	assert.NoError(t, err)
+	assert.True(t, diff.RequiresNew())
+}
+
+func TestResourceInstanceNetworkInterfacesDiff(t *testing.T) {
+	testCases := []struct {
+		name       string
+		subnetCIDR cty.Value
+		err        string
+	}{
+		{name: "unknown subnet", subnetCIDR: cty.UnknownVal(cty.String)},
+		{name: "missing subnet", subnetCIDR: cty.NullVal(cty.String), err: "'subnet_cidr' is required when 'ip_address' is set"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			// The unknown values are read as zero values during the plan, only
+			// the raw configuration tells them apart
+			configType := resourceMaasInstance().CoreConfigSchema().ImpliedType()
+			networkInterfaceType := configType.AttributeType("network_interfaces").ElementType()
+			networkInterface := map[string]cty.Value{}
+			for k, attrType := range networkInterfaceType.AttributeTypes() {
+				networkInterface[k] = cty.NullVal(attrType)
+			}
+			networkInterface["name"] = cty.StringVal("eth0")
+			networkInterface["ip_address"] = cty.StringVal("10.0.0.5")
+			networkInterface["subnet_cidr"] = testCase.subnetCIDR
+			rawConfig := map[string]cty.Value{}
+			for k, attrType := range configType.AttributeTypes() {
+				rawConfig[k] = cty.NullVal(attrType)
+			}
+			rawConfig["network_interfaces"] = cty.SetVal([]cty.Value{cty.ObjectVal(networkInterface)})
+
+			state := &terraform.InstanceState{RawConfig: cty.ObjectVal(rawConfig)}
+			config := terraform.NewResourceConfigRaw(map[string]interface{}{
+				"network_interfaces": []interface{}{map[string]interface{}{"name": "eth0", "ip_address": "10.0.0.5"}},
+			})
+			_, err := resourceMaasInstance().Diff(context.Background(), state, config, nil)
+			if testCase.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, testCase.err)
+			}
+		})
+	}
+}
+
+func TestGetInstanceNetworkInterfacesInfo(t *testing.T) {
+	networkInterfaces := []entity.NetworkInterface{
+		{
+			Name:       "eth0",
+			Type:       "physical",
+			MACAddress: "00:16:3e:00:00:01",
+			VLAN:       entity.VLAN{VID: 0, Fabric: "fabric-0"},
+			Links: []entity.NetworkInterfaceLink{
+				{Mode: "static", IPAddress: "10.0.0.10", Subnet: entity.Subnet{CIDR: "10.0.0.0/24"}},
+				{Mode: "auto", IPAddress: "10.0.0.11", Subnet: entity.Subnet{CIDR: "10.0.0.0/24"}},
+			},
+		},
+		{
+			Name:       "eth1",
+			Type:       "physical",
+			MACAddress: "00:16:3e:00:00:02",
+			VLAN:       entity.VLAN{VID: 100, Fabric: "fabric-1"},
+		},
+	}
+
+	assert.Equal(t, []map[string]interface{}{
+		{"fabric": "fabric-0", "ip_address": "10.0.0.10", "mac_address": "00:16:3e:00:00:01", "mode": "STATIC", "name": "eth0", "subnet_cidr": "10.0.0.0/24", "type": "physical", "vlan": 0},
+		{"fabric": "fabric-1", "ip_address": "", "mac_address": "00:16:3e:00:00:02", "mode": "", "name": "eth1", "subnet_cidr": "", "type": "physical", "vlan": 100},
+	}, getInstanceNetworkInterfacesInfo(networkInterfaces))
+}
+
+func TestGetOwnerDataParams(t *testing.T) {
+	params := getOwnerDataParams(
+		map[string]interface{}{"team": "infra", "ticket": "OPS-1"},
+		map[string]interface{}{"team": "platform", "service": "db"},
+	)
+	assert.Equal(t, url.Values{"team": {"platform"}, "ticket": {""}, "service": {"db"}}, params)
+}
+
+func TestValidateAllocateParams(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, dataSourceMaasAllocationCandidates().Schema, map[string]interface{}{
+		"pool":        "gpu",
+		"not_in_pool": []interface{}{"gpu"},
+	})
+	allocateParams := map[string]interface{}{}
+	for k := range getAllocateParamsSchema(false) {
+		allocateParams[k] = d.Get(k)
+	}
+	assert.EqualError(t, validateAllocateParams(allocateParams), `"gpu" is set in both 'pool' and 'not_in_pool'`)
+
+	allocateParams["not_in_pool"] = schema.NewSet(schema.HashString, []interface{}{"default"})
+	assert.NoError(t, validateAllocateParams(allocateParams))
+}
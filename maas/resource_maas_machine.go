@@ -2,13 +2,16 @@ package maas
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"reflect"
+	"strings"
 	"time"
 
 	"github.com/canonical/gomaasclient/client"
 	"github.com/canonical/gomaasclient/entity"
+	"github.com/google/go-querystring/query"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/retry"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
@@ -16,6 +19,11 @@ import (
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
 )
 
+const (
+	machineOnDestroyDelete = "delete"
+	machineOnDestroyForget = "forget"
+)
+
 func resourceMaasMachine() *schema.Resource {
 	return &schema.Resource{
 		Description:   "Provides a resource to manage MAAS machines.",
@@ -23,6 +31,7 @@ func resourceMaasMachine() *schema.Resource {
 		ReadContext:   resourceMachineRead,
 		UpdateContext: resourceMachineUpdate,
 		DeleteContext: resourceMachineDelete,
+		CustomizeDiff: resourceMachineCustomizeDiff,
 		SchemaVersion: 1,
 		StateUpgraders: []schema.StateUpgrader{
 			{
@@ -52,6 +61,7 @@ func resourceMaasMachine() *schema.Resource {
 					"power_parameters": powerParamsString,
 					"pxe_mac_address":  machine.BootInterface.MACAddress,
 					"architecture":     machine.Architecture,
+					"deployed":         machine.StatusName == "Deployed",
 				}
 				if err := setTerraformState(d, tfState); err != nil {
 					return nil, err
@@ -67,18 +77,43 @@ func resourceMaasMachine() *schema.Resource {
 				Default:     "amd64/generic",
 				Description: "The architecture type of the machine. Defaults to `amd64/generic`.",
 			},
+			"cpu_count": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The number of CPU cores of the machine, as discovered by MAAS.",
+			},
+			"deployed": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+				DiffSuppressFunc: func(k, oldValue, newValue string, d *schema.ResourceData) bool {
+					return d.Id() != ""
+				},
+				Description: "Register a machine that is already deployed and running outside MAAS (MAAS 3.1 or later). The machine is added in the `Deployed` state, without being commissioned or reinstalled. Its hardware details are discovered once the machine reports them to MAAS (e.g. with `maas-run-scripts`). It's only used when the machine is registered, changing it later has no effect. Destroying a deployed machine requires `force_delete`. Defaults to `false`.",
+			},
 			"domain": {
 				Type:        schema.TypeString,
 				Optional:    true,
 				Computed:    true,
 				Description: "The domain of the machine. This is computed if it's not set.",
 			},
+			"force_delete": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Allow the machine to be released or deleted on destroy while it is in use, i.e. in any state but `New`, `Ready`, `Broken`, `Failed commissioning` and `Failed testing`. Defaults to `false`, in which case destroying a machine in use fails.",
+			},
 			"hostname": {
 				Type:        schema.TypeString,
 				Optional:    true,
 				Computed:    true,
 				Description: "The machine hostname. This is computed if it's not set.",
 			},
+			"memory": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The RAM memory of the machine, in MB, as discovered by MAAS.",
+			},
 			"min_hwe_kernel": {
 				Type:        schema.TypeString,
 				Optional:    true,
@@ -93,16 +128,64 @@ func resourceMaasMachine() *schema.Resource {
 					Type: schema.TypeString,
 				},
 			},
+			"on_destroy": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				MaxItems:    1,
+				Description: "Nested argument with the behaviour used when the resource is destroyed. Defined below. Changes to this argument must be applied before they are used by a destroy.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"action": {
+							Type:             schema.TypeString,
+							Optional:         true,
+							Default:          machineOnDestroyDelete,
+							ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice([]string{machineOnDestroyDelete, machineOnDestroyForget}, false)),
+							Description:      "The action taken when the resource is destroyed. Supported values are: `delete` (the machine is deleted from MAAS), `forget` (the machine is left in MAAS and only removed from the Terraform state). Defaults to `delete`.",
+						},
+						"erase": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Default:     false,
+							Description: "Erase the machine disks when it is released. This implies `release`.",
+						},
+						"quick_erase": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Default:     false,
+							Description: "Wipe 2MiB at the start and at the end of the machine disks when it is released. This implies `erase`.",
+						},
+						"release": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Default:     false,
+							Description: "Release the machine, and wait for it to be `Ready`, before the `action` is taken. This only applies if the machine is allocated or deployed.",
+						},
+						"secure_erase": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Default:     false,
+							Description: "Use the secure erase feature of the machine disks, if available, when it is released. This implies `erase`.",
+						},
+					},
+				},
+			},
 			"pool": {
 				Type:        schema.TypeString,
 				Optional:    true,
 				Computed:    true,
 				Description: "The resource pool of the machine. This is computed if it's not set.",
 			},
+			"power_ipmi":    powerTypeIPMISchema(),
+			"power_lxd":     powerTypeLXDSchema(),
+			"power_proxmox": powerTypeProxmoxSchema(),
+			"power_redfish": powerTypeRedfishSchema(),
+			"power_virsh":   powerTypeVirshSchema(),
+			"power_webhook": powerTypeWebhookSchema(),
 			"power_parameters": {
 				Type:         schema.TypeString,
-				Required:     true,
+				Optional:     true,
 				Sensitive:    true,
+				ExactlyOneOf: getPowerParametersArguments(),
 				ValidateFunc: validation.StringIsJSON,
 				DiffSuppressFunc: func(k, oldValue, newValue string, d *schema.ResourceData) bool {
 					oldMap, err := structure.ExpandJsonFromString(oldValue)
@@ -119,25 +202,23 @@ func resourceMaasMachine() *schema.Resource {
 					json, _ := structure.NormalizeJsonString(v)
 					return json
 				},
-				Description: "Serialized JSON string containing the parameters specific to the `power_type`. See [Power types](https://maas.io/docs/api#power-types) section for a list of the available power parameters for each power type.",
+				Description: "Serialized JSON string containing the parameters specific to the `power_type`. See [Power types](https://maas.io/docs/api#power-types) section for a list of the available power parameters for each power type. The parameters are validated against the power driver described by MAAS. This argument conflicts with the typed power blocks (e.g. `power_ipmi`).",
 			},
 			"power_type": {
 				Type:        schema.TypeString,
 				Required:    true,
-				Description: "A power management type (e.g. `ipmi`).",
-				ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice(
-					[]string{
-						"amt", "apc", "dli", "eaton", "hmc", "ipmi", "manual", "moonshot",
-						"mscm", "msftocs", "nova", "openbmc", "proxmox", "recs_box", "redfish",
-						"sm15k", "ucsm", "vmware", "webhook", "wedge", "lxd", "virsh",
-					},
-					false)),
+				Description: "A power management type (e.g. `ipmi`). It is validated against the power types supported by MAAS.",
 			},
 			"pxe_mac_address": {
 				Type:        schema.TypeString,
 				Required:    true,
 				Description: "The MAC address of the machine's PXE boot NIC.",
 			},
+			"storage": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The total storage of the machine, in MB, as discovered by MAAS.",
+			},
 			"zone": {
 				Type:        schema.TypeString,
 				Optional:    true,
@@ -147,6 +228,7 @@ func resourceMaasMachine() *schema.Resource {
 		},
 		Timeouts: &schema.ResourceTimeout{
 			Create: schema.DefaultTimeout(30 * time.Minute),
+			Delete: schema.DefaultTimeout(30 * time.Minute),
 		},
 	}
 }
@@ -159,7 +241,18 @@ func resourceMachineCreate(ctx context.Context, d *schema.ResourceData, meta int
 	if err != nil {
 		return diag.FromErr(err)
 	}
-	machine, err := client.Machines.Create(getMachineParams(d), powerParams)
+	var machine *entity.Machine
+	if d.Get("deployed").(bool) {
+		machine, err = createDeployedMachine(client, getMachineParams(d), powerParams)
+	} else {
+		// Wait for a deployment slot, held until the commissioning ends
+		releaseSlot, slotErr := acquireDeploymentSlots(ctx, client, 1, fmt.Sprintf("Commissioning of machine (%s)", d.Get("pxe_mac_address")))
+		if slotErr != nil {
+			return diag.FromErr(slotErr)
+		}
+		defer releaseSlot()
+		machine, err = client.Machines.Create(getMachineParams(d), powerParams)
+	}
 	if err != nil {
 		return diag.FromErr(err)
 	}
@@ -167,8 +260,12 @@ func resourceMachineCreate(ctx context.Context, d *schema.ResourceData, meta int
 	// Save Id
 	d.SetId(machine.SystemID)
 
-	// Wait for machine to be ready
-	_, err = waitForMachineStatus(ctx, client, machine.SystemID, []string{"Commissioning", "Testing"}, []string{"Ready"}, d.Timeout(schema.TimeoutCreate))
+	// Wait for machine to be ready, or deployed if it's already running
+	if d.Get("deployed").(bool) {
+		_, err = waitForMachineStatus(ctx, client, machine.SystemID, []string{"New"}, []string{"Deployed"}, d.Timeout(schema.TimeoutCreate))
+	} else {
+		_, err = waitForMachineStatus(ctx, client, machine.SystemID, []string{"Commissioning", "Testing"}, []string{"Ready"}, d.Timeout(schema.TimeoutCreate))
+	}
 	if err != nil {
 		return diag.FromErr(err)
 	}
@@ -194,6 +291,9 @@ func resourceMachineRead(ctx context.Context, d *schema.ResourceData, meta inter
 		"domain":         machine.Domain.Name,
 		"zone":           machine.Zone.Name,
 		"pool":           machine.Pool.Name,
+		"cpu_count":      machine.CPUCount,
+		"memory":         machine.Memory,
+		"storage":        int(machine.Storage),
 	}
 	if err := setTerraformState(d, tfState); err != nil {
 		return diag.FromErr(err)
@@ -232,6 +332,34 @@ func resourceMachineUpdate(ctx context.Context, d *schema.ResourceData, meta int
 func resourceMachineDelete(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
 	client := meta.(*client.Client)
 
+	action, releaseParams := getMachineOnDestroyParams(d)
+
+	// Forget the machine without touching it in MAAS
+	if action == machineOnDestroyForget && releaseParams == nil {
+		log.Printf("[DEBUG] Machine (%s) is left in MAAS and removed from the Terraform state\n", d.Id())
+		return nil
+	}
+
+	// Refuse to touch a machine that is in use, unless forced
+	machine, err := client.Machine.Get(d.Id())
+	if err != nil {
+		return diag.FromErr(err)
+	}
+	if isMachineInUse(machine) && !d.Get("force_delete").(bool) {
+		return diag.Errorf("machine (%s) is %s: set 'force_delete = true' to destroy it", machine.Hostname, machine.StatusName)
+	}
+
+	// Release machine, and wait for it to be ready
+	if isMachineReleasable(machine) && releaseParams != nil {
+		if err := releaseMachine(ctx, client, machine.SystemID, releaseParams, nil, d.Timeout(schema.TimeoutDelete)); err != nil {
+			return diag.FromErr(err)
+		}
+	}
+	if action == machineOnDestroyForget {
+		log.Printf("[DEBUG] Machine (%s) is left in MAAS and removed from the Terraform state\n", d.Id())
+		return nil
+	}
+
 	// Delete machine
 	if err := client.Machine.Delete(d.Id()); err != nil {
 		return diag.FromErr(err)
@@ -240,10 +368,108 @@ func resourceMachineDelete(ctx context.Context, d *schema.ResourceData, meta int
 	return nil
 }
 
+// getMachineOnDestroyParams returns the destroy action, and the release params
+// if the machine must be released before the action is taken.
+func getMachineOnDestroyParams(d *schema.ResourceData) (string, *entity.MachineReleaseParams) {
+	p, ok := d.GetOk("on_destroy")
+	if !ok {
+		return machineOnDestroyDelete, nil
+	}
+	onDestroyData := p.([]interface{})
+	if onDestroyData[0] == nil {
+		return machineOnDestroyDelete, nil
+	}
+	onDestroy := onDestroyData[0].(map[string]interface{})
+	action := onDestroy["action"].(string)
+	releaseParams := &entity.MachineReleaseParams{
+		Comment:     "Released by Terraform",
+		SecureErase: onDestroy["secure_erase"].(bool),
+		QuickErase:  onDestroy["quick_erase"].(bool),
+	}
+	releaseParams.Erase = onDestroy["erase"].(bool) || releaseParams.SecureErase || releaseParams.QuickErase
+	if !releaseParams.Erase && !onDestroy["release"].(bool) {
+		return action, nil
+	}
+	return action, releaseParams
+}
+
+// isMachineInUse returns whether the machine is in any state but the idle
+// ones, e.g. allocated, deployed, releasing or in rescue mode.
+func isMachineInUse(machine *entity.Machine) bool {
+	switch machine.StatusName {
+	case "New", "Ready", "Broken", "Failed commissioning", "Failed testing":
+		return false
+	}
+	return true
+}
+
+// isMachineReleasable returns whether the machine can be released.
+func isMachineReleasable(machine *entity.Machine) bool {
+	switch machine.StatusName {
+	case "Allocated", "Deploying", "Deployed", "Failed deployment":
+		return true
+	}
+	return false
+}
+
+func resourceMachineCustomizeDiff(ctx context.Context, d *schema.ResourceDiff, meta interface{}) error {
+	if !d.NewValueKnown("power_type") {
+		return nil
+	}
+
+	// Check the typed power block matches the power type
+	powerType := d.Get("power_type").(string)
+	for block, blockPowerType := range powerTypeBlocks {
+		if len(d.Get(block).([]interface{})) > 0 && blockPowerType != powerType {
+			return fmt.Errorf("%q can only be used when 'power_type' is %q", block, blockPowerType)
+		}
+	}
+
+	// Validate the power parameters against the power driver described by MAAS
+	if meta == nil || !d.HasChanges(append(getPowerParametersArguments(), "power_type")...) {
+		return nil
+	}
+	client := meta.(*client.Client)
+	driver, err := getPowerType(client, powerType)
+	if err != nil {
+		return err
+	}
+	config := d.GetRawConfig()
+	for _, k := range getPowerParametersArguments() {
+		isKnown := d.NewValueKnown(k)
+		if !config.IsNull() {
+			isKnown = config.GetAttr(k).IsWhollyKnown()
+		}
+		if !isKnown {
+			return nil
+		}
+	}
+	params, err := getMachinePowerParamsFromConfig(d)
+	if err != nil {
+		return err
+	}
+
+	return validatePowerParameters(driver, params)
+}
+
+// getMachinePowerParamsFromConfig returns the power parameters given either
+// with the `power_parameters` JSON string, or with a typed power block.
+func getMachinePowerParamsFromConfig(d interface{ Get(string) interface{} }) (map[string]interface{}, error) {
+	for block := range powerTypeBlocks {
+		if p := d.Get(block).([]interface{}); len(p) > 0 && p[0] != nil {
+			return getPowerTypeBlockParams(p[0].(map[string]interface{})), nil
+		}
+	}
+	powerParamsString := d.Get("power_parameters").(string)
+	if powerParamsString == "" {
+		return map[string]interface{}{}, nil
+	}
+	return structure.ExpandJsonFromString(powerParamsString)
+}
+
 func getMachinePowerParams(d *schema.ResourceData) (powerParams map[string]interface{}, err error) {
 	powerParams = make(map[string]interface{})
-	powerParamsString := d.Get("power_parameters").(string)
-	params, err := structure.ExpandJsonFromString(powerParamsString)
+	params, err := getMachinePowerParamsFromConfig(d)
 	if err != nil {
 		return powerParams, err
 	}
@@ -253,6 +479,38 @@ func getMachinePowerParams(d *schema.ResourceData) (powerParams map[string]inter
 	return powerParams, nil
 }
 
+// createDeployedMachine registers a machine that is already deployed outside
+// MAAS. The `deployed` parameter is not supported by gomaasclient, so the
+// machine is created with the MAAS API client directly.
+func createDeployedMachine(client *client.Client, machineParams *entity.MachineParams, powerParams map[string]interface{}) (*entity.Machine, error) {
+	apiClient, err := getAPIClient(client)
+	if err != nil {
+		return nil, err
+	}
+	machineParams.Commission = false
+	qsp, err := query.Values(machineParams)
+	if err != nil {
+		return nil, err
+	}
+	qsp.Set("deployed", "true")
+	for k, v := range powerParams {
+		switch v := v.(type) {
+		case []interface{}:
+			for _, e := range v {
+				qsp.Add(k, fmt.Sprint(e))
+			}
+		default:
+			qsp.Add(k, fmt.Sprint(v))
+		}
+	}
+
+	machine := new(entity.Machine)
+	err = apiClient.GetSubObject("machines").Post("", qsp, func(data []byte) error {
+		return json.Unmarshal(data, machine)
+	})
+	return machine, err
+}
+
 func getMachineParams(d *schema.ResourceData) *entity.MachineParams {
 	return &entity.MachineParams{
 		Commission:   true,
@@ -295,6 +553,80 @@ func waitForMachineStatus(ctx context.Context, client *client.Client, systemID s
 	return result.(*entity.Machine), nil
 }
 
+// waitForMachinesStatus waits for all the given machines to leave the pending
+// states, polling them with a single request. The machines are returned by
+// system ID, whatever their final status.
+func waitForMachinesStatus(ctx context.Context, client *client.Client, systemIDs []string, pendingStates []string, maxTimeout time.Duration) (map[string]*entity.Machine, error) {
+	log.Printf("[DEBUG] Waiting for machines (%s) status to leave %s\n", strings.Join(systemIDs, ", "), pendingStates)
+	pending := map[string]bool{}
+	for _, state := range pendingStates {
+		pending[state] = true
+	}
+	stateConf := &retry.StateChangeConf{
+		Pending: []string{"pending"},
+		Target:  []string{"done"},
+		Refresh: func() (interface{}, string, error) {
+			machines, err := client.Machines.Get(&entity.MachinesParams{ID: systemIDs})
+			if err != nil {
+				return nil, "", err
+			}
+			result := map[string]*entity.Machine{}
+			state := "done"
+			for i := range machines {
+				machine := &machines[i]
+				result[machine.SystemID] = machine
+				if pending[machine.StatusName] {
+					state = "pending"
+				}
+			}
+			log.Printf("[DEBUG] Machines (%s) status: %s\n", strings.Join(systemIDs, ", "), state)
+			return result, state, nil
+		},
+		Timeout:    maxTimeout,
+		Delay:      10 * time.Second,
+		MinTimeout: 3 * time.Second,
+	}
+	result, err := stateConf.WaitForStateContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return result.(map[string]*entity.Machine), nil
+}
+
+// releaseMachine releases the machine and waits for it to be ready, failing
+// if the release, or the disk erasing, fails. The release scripts are not
+// supported by gomaasclient, so the MAAS API client is used directly when
+// they are given.
+func releaseMachine(ctx context.Context, client *client.Client, systemID string, releaseParams *entity.MachineReleaseParams, scripts []string, timeout time.Duration) error {
+	if len(scripts) == 0 {
+		if _, err := client.Machine.Release(systemID, releaseParams); err != nil {
+			return err
+		}
+	} else {
+		apiClient, err := getAPIClient(client)
+		if err != nil {
+			return err
+		}
+		qsp, err := query.Values(releaseParams)
+		if err != nil {
+			return err
+		}
+		qsp.Set("scripts", strings.Join(scripts, ","))
+		if err := apiClient.GetSubObject("machines").GetSubObject(systemID).Post("release", qsp, func(data []byte) error { return nil }); err != nil {
+			return err
+		}
+	}
+
+	machine, err := waitForMachineStatus(ctx, client, systemID, []string{"Releasing", "Disk erasing"}, []string{"Ready", "Failed releasing", "Failed disk erasing"}, timeout)
+	if err != nil {
+		return err
+	}
+	if machine.StatusName != "Ready" {
+		return fmt.Errorf("machine (%s) failed to be released, its status is %s: %s", machine.Hostname, machine.StatusName, machine.StatusMessage)
+	}
+	return nil
+}
+
 func getMachine(client *client.Client, identifier string) (*entity.Machine, error) {
 	machines, err := client.Machines.Get(&entity.MachinesParams{})
 	if err != nil {
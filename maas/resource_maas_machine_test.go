@@ -0,0 +1,160 @@
+package maas
+
+import (
+	"context"
+	"testing"
+
+	"github.com/canonical/gomaasclient/client"
+	"github.com/canonical/gomaasclient/entity"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetMachineOnDestroyParams(t *testing.T) {
+	testCases := []struct {
+		name          string
+		raw           map[string]interface{}
+		action        string
+		releaseParams *entity.MachineReleaseParams
+	}{
+		{
+			name:   "no on_destroy",
+			raw:    map[string]interface{}{},
+			action: machineOnDestroyDelete,
+		},
+		{
+			name: "forget without release",
+			raw: map[string]interface{}{
+				"on_destroy": []interface{}{map[string]interface{}{"action": "forget"}},
+			},
+			action: machineOnDestroyForget,
+		},
+		{
+			name: "release",
+			raw: map[string]interface{}{
+				"on_destroy": []interface{}{map[string]interface{}{"release": true}},
+			},
+			action:        machineOnDestroyDelete,
+			releaseParams: &entity.MachineReleaseParams{Comment: "Released by Terraform"},
+		},
+		{
+			name: "secure erase implies erase",
+			raw: map[string]interface{}{
+				"on_destroy": []interface{}{map[string]interface{}{"secure_erase": true}},
+			},
+			action:        machineOnDestroyDelete,
+			releaseParams: &entity.MachineReleaseParams{Comment: "Released by Terraform", Erase: true, SecureErase: true},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			d := schema.TestResourceDataRaw(t, resourceMaasMachine().Schema, testCase.raw)
+			action, releaseParams := getMachineOnDestroyParams(d)
+			assert.Equal(t, testCase.action, action)
+			assert.Equal(t, testCase.releaseParams, releaseParams)
+		})
+	}
+}
+
+func TestIsMachineInUse(t *testing.T) {
+	for status, inUse := range map[string]bool{
+		"New":                  false,
+		"Ready":                false,
+		"Broken":               false,
+		"Failed commissioning": false,
+		"Allocated":            true,
+		"Deployed":             true,
+		"Releasing":            true,
+		"Rescue mode":          true,
+		"Commissioning":        true,
+	} {
+		assert.Equal(t, inUse, isMachineInUse(&entity.Machine{StatusName: status}), status)
+	}
+}
+
+// testUnknownValue is the legacy SDK representation of an unknown value.
+const testUnknownValue = "74D93920-ED26-11E3-AC10-0800200C9A66"
+
+func TestResourceMachinePowerDiff(t *testing.T) {
+	c := &client.Client{}
+	powerTypesCache.Lock()
+	powerTypesCache.powerTypes[c] = []PowerType{{
+		Name: "ipmi",
+		Fields: []PowerTypeField{
+			{Name: "power_address", Required: true},
+			{Name: "power_user"},
+			{Name: "power_pass", Secret: true},
+		},
+	}}
+	powerTypesCache.Unlock()
+	defer func() {
+		powerTypesCache.Lock()
+		delete(powerTypesCache.powerTypes, c)
+		powerTypesCache.Unlock()
+	}()
+
+	testCases := []struct {
+		name   string
+		config map[string]interface{}
+		err    string
+	}{
+		{
+			name:   "unknown hostname",
+			config: map[string]interface{}{"hostname": testUnknownValue, "power_type": "ipmi", "power_parameters": `{"power_address": "10.0.0.1"}`},
+		},
+		{
+			name:   "invalid power type with unknown hostname",
+			config: map[string]interface{}{"hostname": testUnknownValue, "power_type": "bogus", "power_parameters": `{}`},
+			err:    "power type (bogus) is not supported by MAAS, expected one of: ipmi",
+		},
+		{
+			name:   "missing parameter with unknown hostname",
+			config: map[string]interface{}{"hostname": testUnknownValue, "power_type": "ipmi", "power_parameters": `{"power_user": "admin"}`},
+			err:    `power parameter "power_address" is required for power type "ipmi"`,
+		},
+		{
+			name:   "unknown power parameters",
+			config: map[string]interface{}{"power_type": "ipmi", "power_parameters": testUnknownValue},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.config["pxe_mac_address"] = "00:00:00:00:00:01"
+			_, err := resourceMaasMachine().Diff(context.Background(), nil, terraform.NewResourceConfigRaw(testCase.config), c)
+			if testCase.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, testCase.err)
+			}
+		})
+	}
+}
+
+func TestResourceMachineDeployedDiff(t *testing.T) {
+	state := &terraform.InstanceState{
+		ID: "abc123",
+		Attributes: map[string]string{
+			"id":               "abc123",
+			"power_type":       "manual",
+			"power_parameters": "{}",
+			"pxe_mac_address":  "00:00:00:00:00:01",
+			"deployed":         "false",
+		},
+	}
+	config := terraform.NewResourceConfigRaw(map[string]interface{}{
+		"power_type":       "manual",
+		"power_parameters": "{}",
+		"pxe_mac_address":  "00:00:00:00:00:01",
+		"deployed":         true,
+	})
+
+	diff, err := resourceMaasMachine().Diff(context.Background(), state, config, nil)
+	assert.NoError(t, err)
+	if diff != nil {
+		assert.False(t, diff.RequiresNew())
+		assert.NotContains(t, diff.Attributes, "deployed")
+	}
+}
@@ -252,7 +252,7 @@ func resourceNetworkInterfaceBondDelete(ctx context.Context, d *schema.ResourceD
 	return nil
 }
 
-func getNetworkInterfaceBondParams(d *schema.ResourceData, parentIDs []int) *entity.NetworkInterfaceBondParams {
+func getNetworkInterfaceBondParams(d interface{ Get(string) interface{} }, parentIDs []int) *entity.NetworkInterfaceBondParams {
 	return &entity.NetworkInterfaceBondParams{
 		AcceptRA:           d.Get("accept_ra").(bool),
 		BondDownDelay:      d.Get("bond_downdelay").(int),
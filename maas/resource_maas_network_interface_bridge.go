@@ -217,7 +217,7 @@ func resourceNetworkInterfaceBridgeDelete(ctx context.Context, d *schema.Resourc
 	return nil
 }
 
-func getNetworkInterfaceBridgeParams(d *schema.ResourceData, parentID int) *entity.NetworkInterfaceBridgeParams {
+func getNetworkInterfaceBridgeParams(d interface{ Get(string) interface{} }, parentID int) *entity.NetworkInterfaceBridgeParams {
 	return &entity.NetworkInterfaceBridgeParams{
 		AcceptRA:   d.Get("accept_ra").(bool),
 		BridgeType: d.Get("bridge_type").(string),
@@ -199,7 +199,7 @@ func resourceNetworkInterfaceVlanDelete(ctx context.Context, d *schema.ResourceD
 	return nil
 }
 
-func getNetworkInterfaceVlanParams(d *schema.ResourceData, parentID int, vlanID int) *entity.NetworkInterfaceVLANParams {
+func getNetworkInterfaceVlanParams(d interface{ Get(string) interface{} }, parentID int, vlanID int) *entity.NetworkInterfaceVLANParams {
 	return &entity.NetworkInterfaceVLANParams{
 		AcceptRA: d.Get("accept_ra").(bool),
 		MTU:      d.Get("mtu").(int),
@@ -2,8 +2,15 @@ package maas
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"math/big"
 	"net/http"
 	"strconv"
 	"strings"
@@ -11,6 +18,7 @@ import (
 
 	"github.com/canonical/gomaasclient/client"
 	"github.com/canonical/gomaasclient/entity"
+	"github.com/google/go-querystring/query"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
@@ -31,6 +39,7 @@ func resourceMaasVMHost() *schema.Resource {
 		ReadContext:   resourceVMHostRead,
 		UpdateContext: resourceVMHostUpdate,
 		DeleteContext: resourceVMHostDelete,
+		CustomizeDiff: resourceVMHostCustomizeDiff,
 		Importer: &schema.ResourceImporter{
 			StateContext: func(ctx context.Context, d *schema.ResourceData, meta interface{}) ([]*schema.ResourceData, error) {
 				client := meta.(*client.Client)
@@ -49,7 +58,7 @@ func resourceMaasVMHost() *schema.Resource {
 					if err != nil {
 						return nil, err
 					}
-					for _, k := range []string{"power_address", "power_user", "power_pass"} {
+					for _, k := range []string{"power_address", "power_user", "power_pass", "certificate", "key", "project"} {
 						if val, ok := vmHostParams[k]; ok {
 							tfState[k] = val
 						}
@@ -63,18 +72,41 @@ func resourceMaasVMHost() *schema.Resource {
 		},
 
 		Schema: map[string]*schema.Schema{
+			"certificate": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				Computed:      true,
+				ConflictsWith: []string{"machine"},
+				RequiredWith:  []string{"key"},
+				Description:   "The PEM encoded client certificate used by MAAS to connect to the LXD VM host. A self-signed certificate is generated if it's not set: it must be added to the LXD trust store, unless `password` is set. Only valid for the `lxd` VM hosts.",
+			},
 			"cpu_over_commit_ratio": {
 				Type:        schema.TypeFloat,
 				Optional:    true,
 				Computed:    true,
 				Description: "The new VM host CPU overcommit ratio. This is computed if it's not set.",
 			},
+			"default_storage_pool": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "The name of the default storage pool of the VM host, used by the VM host machines disks without a pool. This is computed if it's not set.",
+			},
 			"default_macvlan_mode": {
 				Type:        schema.TypeString,
 				Optional:    true,
 				Computed:    true,
 				Description: "The new VM host default macvlan mode. Supported values are: `bridge`, `passthru`, `private`, `vepa`. This is computed if it's not set.",
 			},
+			"key": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				Computed:      true,
+				Sensitive:     true,
+				ConflictsWith: []string{"machine"},
+				RequiredWith:  []string{"certificate"},
+				Description:   "The PEM encoded private key of `certificate`. This is computed if `certificate` is not set. Only valid for the `lxd` VM hosts.",
+			},
 			"machine": {
 				Type:          schema.TypeString,
 				Optional:      true,
@@ -95,6 +127,16 @@ func resourceMaasVMHost() *schema.Resource {
 				Computed:    true,
 				Description: "The new VM host name. This is computed if it's not set.",
 			},
+			"password": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				Sensitive:     true,
+				ConflictsWith: []string{"machine"},
+				DiffSuppressFunc: func(k, oldValue, newValue string, d *schema.ResourceData) bool {
+					return d.Id() != ""
+				},
+				Description: "The LXD trust password, used by MAAS to add `certificate` to the LXD trust store when the VM host is created. Only valid for the `lxd` VM hosts. It's only used on create, changing it later has no effect.",
+			},
 			"pool": {
 				Type:        schema.TypeString,
 				Optional:    true,
@@ -121,21 +163,117 @@ func resourceMaasVMHost() *schema.Resource {
 				ConflictsWith: []string{"machine"},
 				Description:   "User name to use for power control of the VM host. Cannot be set if `machine` parameter is used.",
 			},
+			"project": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				Computed:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"machine"},
+				Description:   "The LXD project managed by MAAS on the VM host. The project is created if it doesn't exist. This is computed if it's not set. Only valid for the `lxd` VM hosts.",
+			},
+			"refresh_on_read": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Refresh the VM host resources, and VMs, every time the VM host is read. Defaults to `false`.",
+			},
+			"refresh_triggers": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Description: "A map of arbitrary values that refreshes the VM host resources, and VMs, when changed. Set it with the attributes of the resources changing the underlying host (e.g. its disks or network interfaces), so the new capacity shows up in the same apply.",
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
+			"resources_cores_available": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The VM host number of available CPU cores.",
+			},
 			"resources_cores_total": {
 				Type:        schema.TypeInt,
 				Computed:    true,
 				Description: "The VM host total number of CPU cores.",
 			},
+			"resources_cores_used": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The VM host number of CPU cores used by the VMs.",
+			},
+			"resources_local_storage_available": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The VM host available local storage (in bytes).",
+			},
 			"resources_local_storage_total": {
 				Type:        schema.TypeInt,
 				Computed:    true,
 				Description: "The VM host total local storage (in bytes).",
 			},
+			"resources_local_storage_used": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The VM host local storage used by the VMs (in bytes).",
+			},
+			"resources_memory_available": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The VM host available RAM memory (in MB).",
+			},
 			"resources_memory_total": {
 				Type:        schema.TypeInt,
 				Computed:    true,
 				Description: "The VM host total RAM memory (in MB).",
 			},
+			"resources_memory_used": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The VM host RAM memory used by the VMs (in MB).",
+			},
+			"storage_pools": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "The storage pools of the VM host.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"available": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "The available storage (in bytes).",
+						},
+						"default": {
+							Type:        schema.TypeBool,
+							Computed:    true,
+							Description: "Whether this is the default storage pool of the VM host.",
+						},
+						"name": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The storage pool name.",
+						},
+						"path": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The storage pool path.",
+						},
+						"total": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "The total storage (in bytes).",
+						},
+						"type": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The storage pool type (e.g. `dir`, `lvm` or `zfs`).",
+						},
+						"used": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "The storage used by the VMs (in bytes).",
+						},
+					},
+				},
+			},
 			"tags": {
 				Type:        schema.TypeSet,
 				Optional:    true,
@@ -179,7 +317,25 @@ func resourceVMHostCreate(ctx context.Context, d *schema.ResourceData, meta inte
 			return diag.FromErr(err)
 		}
 	} else {
-		vmHost, err = client.VMHosts.Create(getVMHostParams(d))
+		// Generate the LXD client certificate, unless it's given
+		if d.Get("type").(string) == "lxd" && d.Get("certificate").(string) == "" {
+			certificate, key, err := generateVMHostCertificate(d.Get("name").(string))
+			if err != nil {
+				return diag.FromErr(err)
+			}
+			if err := setTerraformState(d, map[string]interface{}{"certificate": certificate, "key": key}); err != nil {
+				return diag.FromErr(err)
+			}
+		}
+		// The VM host has no storage pools until it's created, the default
+		// storage pool is set by the update below
+		params := getVMHostParams(d)
+		params.DefaultStoragePool = ""
+		vmHost, err = createVMHost(client, &vmHostParams{
+			VMHostParams: *params,
+			Password:     d.Get("password").(string),
+			Project:      d.Get("project").(string),
+		})
 		if err != nil {
 			return diag.FromErr(err)
 		}
@@ -200,23 +356,47 @@ func resourceVMHostRead(ctx context.Context, d *schema.ResourceData, meta interf
 	if err != nil {
 		return diag.FromErr(err)
 	}
-	vmHost, err := client.VMHost.Get(id)
+	var vmHost *entity.VMHost
+	if d.Get("refresh_on_read").(bool) {
+		// MAAS discovers the VM host within the refresh request, and returns
+		// it with the refreshed resources
+		vmHost, err = client.VMHost.Refresh(id)
+	} else {
+		vmHost, err = client.VMHost.Get(id)
+	}
 	if err != nil {
 		return diag.FromErr(err)
 	}
 
 	// Set Terraform state
 	tfState := map[string]interface{}{
-		"name":                          vmHost.Name,
-		"zone":                          vmHost.Zone.Name,
-		"pool":                          vmHost.Pool.Name,
-		"tags":                          vmHost.Tags,
-		"cpu_over_commit_ratio":         vmHost.CPUOverCommitRatio,
-		"memory_over_commit_ratio":      vmHost.MemoryOverCommitRatio,
-		"default_macvlan_mode":          vmHost.DefaultMACVLANMode,
-		"resources_cores_total":         vmHost.Total.Cores,
-		"resources_memory_total":        vmHost.Total.Memory,
-		"resources_local_storage_total": vmHost.Total.LocalStorage,
+		"name":                              vmHost.Name,
+		"zone":                              vmHost.Zone.Name,
+		"pool":                              vmHost.Pool.Name,
+		"tags":                              vmHost.Tags,
+		"cpu_over_commit_ratio":             vmHost.CPUOverCommitRatio,
+		"memory_over_commit_ratio":          vmHost.MemoryOverCommitRatio,
+		"default_macvlan_mode":              vmHost.DefaultMACVLANMode,
+		"default_storage_pool":              getVMHostDefaultStoragePool(vmHost),
+		"resources_cores_total":             vmHost.Total.Cores,
+		"resources_cores_used":              vmHost.Used.Cores,
+		"resources_cores_available":         vmHost.Available.Cores,
+		"resources_memory_total":            vmHost.Total.Memory,
+		"resources_memory_used":             vmHost.Used.Memory,
+		"resources_memory_available":        vmHost.Available.Memory,
+		"resources_local_storage_total":     vmHost.Total.LocalStorage,
+		"resources_local_storage_used":      vmHost.Used.LocalStorage,
+		"resources_local_storage_available": vmHost.Available.LocalStorage,
+		"storage_pools":                     getVMHostStoragePoolsState(vmHost.StoragePools),
+	}
+	if vmHost.Type == "lxd" && vmHost.Host.SystemID == "" {
+		vmHostParams, err := client.VMHost.GetParameters(vmHost.ID)
+		if err != nil {
+			return diag.FromErr(err)
+		}
+		if project, ok := vmHostParams["project"]; ok {
+			tfState["project"] = project
+		}
 	}
 	if err := setTerraformState(d, tfState); err != nil {
 		return diag.FromErr(err)
@@ -234,12 +414,40 @@ func resourceVMHostUpdate(ctx context.Context, d *schema.ResourceData, meta inte
 		return diag.FromErr(err)
 	}
 
-	// Update VM host options
-	_, err = client.VMHost.Update(id, getVMHostParams(d))
+	// Update VM host options. The LXD credentials are sent only when they
+	// change, MAAS validates them against the LXD server on every update.
+	params := getVMHostParams(d)
+	if d.IsNewResource() || !d.HasChanges("certificate", "key") {
+		params.Certificate = ""
+		params.Key = ""
+	}
+	// MAAS expects the id of the default storage pool, which is a UUID on
+	// the virsh VM hosts, so it's resolved from the pool name
+	params.DefaultStoragePool = ""
+	if d.HasChange("default_storage_pool") {
+		if pool := d.Get("default_storage_pool").(string); pool != "" {
+			vmHost, err := client.VMHost.Get(id)
+			if err != nil {
+				return diag.FromErr(err)
+			}
+			if params.DefaultStoragePool, err = getVMHostStoragePoolID(vmHost, pool); err != nil {
+				return diag.FromErr(err)
+			}
+		}
+	}
+	_, err = client.VMHost.Update(id, params)
 	if err != nil {
 		return diag.FromErr(err)
 	}
 
+	// Refresh the VM host resources when the triggers change. The resources
+	// are refreshed on read already when `refresh_on_read` is set.
+	if !d.IsNewResource() && d.HasChange("refresh_triggers") && !d.Get("refresh_on_read").(bool) {
+		if _, err := client.VMHost.Refresh(id); err != nil {
+			return diag.FromErr(err)
+		}
+	}
+
 	return resourceVMHostRead(ctx, d, meta)
 }
 
@@ -284,6 +492,113 @@ func resourceVMHostDelete(ctx context.Context, d *schema.ResourceData, meta inte
 	return nil
 }
 
+// resourceVMHostCustomizeDiff marks the VM host resources as unknown when the
+// refresh triggers change, and rejects the LXD options on the virsh VM hosts.
+func resourceVMHostCustomizeDiff(ctx context.Context, d *schema.ResourceDiff, meta interface{}) error {
+	if d.Id() != "" && d.HasChange("refresh_triggers") {
+		for _, k := range vmHostRefreshedAttributes {
+			if err := d.SetNewComputed(k); err != nil {
+				return err
+			}
+		}
+	}
+
+	if d.Get("type").(string) == "lxd" {
+		return nil
+	}
+	// The certificate and the key are computed, so the configuration is
+	// checked instead of the planned values when it's available
+	config := d.GetRawConfig()
+	for _, k := range []string{"certificate", "key", "password", "project"} {
+		isSet := d.Get(k).(string) != ""
+		if !config.IsNull() {
+			isSet = !config.GetAttr(k).IsNull()
+		}
+		if isSet {
+			return fmt.Errorf("%s: can only be set on the lxd VM hosts", k)
+		}
+	}
+	return nil
+}
+
+// vmHostRefreshedAttributes are the attributes updated by a VM host refresh.
+var vmHostRefreshedAttributes = []string{
+	"resources_cores_available",
+	"resources_cores_total",
+	"resources_cores_used",
+	"resources_local_storage_available",
+	"resources_local_storage_total",
+	"resources_local_storage_used",
+	"resources_memory_available",
+	"resources_memory_total",
+	"resources_memory_used",
+	"storage_pools",
+}
+
+// vmHostParams adds the LXD create options not supported by gomaasclient.
+type vmHostParams struct {
+	entity.VMHostParams
+	Password string `url:"password,omitempty"`
+	Project  string `url:"project,omitempty"`
+}
+
+// createVMHost creates the VM host with the MAAS API client directly, so the
+// LXD trust password and project can be given.
+func createVMHost(client *client.Client, params *vmHostParams) (*entity.VMHost, error) {
+	apiClient, err := getAPIClient(client)
+	if err != nil {
+		return nil, err
+	}
+	qsp, err := query.Values(params)
+	if err != nil {
+		return nil, err
+	}
+
+	vmHost := new(entity.VMHost)
+	err = apiClient.GetSubObject("pods").Post("", qsp, func(data []byte) error {
+		return json.Unmarshal(data, vmHost)
+	})
+	return vmHost, err
+}
+
+// generateVMHostCertificate generates the self-signed client certificate, and
+// its private key, used by MAAS to connect to a LXD VM host.
+func generateVMHostCertificate(name string) (string, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+	commonName := "terraform-provider-maas"
+	if name != "" {
+		commonName = fmt.Sprintf("%s@%s", commonName, name)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	certificateDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateDER})
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return string(certificate), string(privateKey), nil
+}
+
 func getVMHostParams(d *schema.ResourceData) *entity.VMHostParams {
 	return &entity.VMHostParams{
 		Name:                  d.Get("name").(string),
@@ -291,15 +606,56 @@ func getVMHostParams(d *schema.ResourceData) *entity.VMHostParams {
 		PowerAddress:          d.Get("power_address").(string),
 		PowerUser:             d.Get("power_user").(string),
 		PowerPass:             d.Get("power_pass").(string),
+		Certificate:           d.Get("certificate").(string),
+		Key:                   d.Get("key").(string),
 		CPUOverCommitRatio:    d.Get("cpu_over_commit_ratio").(float64),
 		MemoryOverCommitRatio: d.Get("memory_over_commit_ratio").(float64),
 		DefaultMacvlanMode:    d.Get("default_macvlan_mode").(string),
+		DefaultStoragePool:    d.Get("default_storage_pool").(string),
 		Zone:                  d.Get("zone").(string),
 		Pool:                  d.Get("pool").(string),
 		Tags:                  strings.Join(convertToStringSlice(d.Get("tags").(*schema.Set).List()), ","),
 	}
 }
 
+// getVMHostDefaultStoragePool returns the name of the default storage pool of
+// the VM host, or an empty string if it has no storage pools.
+func getVMHostDefaultStoragePool(vmHost *entity.VMHost) string {
+	for _, pool := range vmHost.StoragePools {
+		if pool.Default {
+			return pool.Name
+		}
+	}
+	return ""
+}
+
+// getVMHostStoragePoolID returns the id of the VM host storage pool with the
+// given name.
+func getVMHostStoragePoolID(vmHost *entity.VMHost, name string) (string, error) {
+	for _, pool := range vmHost.StoragePools {
+		if pool.Name == name {
+			return pool.ID, nil
+		}
+	}
+	return "", fmt.Errorf("VM host (%s) has no storage pool named (%s)", vmHost.Name, name)
+}
+
+func getVMHostStoragePoolsState(storagePools []entity.VMHostStoragePool) []map[string]interface{} {
+	state := make([]map[string]interface{}, len(storagePools))
+	for i, pool := range storagePools {
+		state[i] = map[string]interface{}{
+			"name":      pool.Name,
+			"type":      pool.Type,
+			"path":      pool.Path,
+			"default":   pool.Default,
+			"total":     pool.Total,
+			"used":      pool.Used,
+			"available": pool.Available,
+		}
+	}
+	return state
+}
+
 func deployMachineAsVMHost(ctx context.Context, client *client.Client, machineIdentifier string, vmHostType string, maxTimeout time.Duration) (*entity.VMHost, error) {
 	// Find machine
 	machine, err := getMachine(client, machineIdentifier)
@@ -340,6 +696,11 @@ func deployMachineAsVMHost(ctx context.Context, client *client.Client, machineId
 		InstallKVM:     (vmHostType == "virsh"),
 		RegisterVMHost: (vmHostType == "lxd"),
 	}
+	releaseSlot, err := acquireDeploymentSlots(ctx, client, 1, fmt.Sprintf("Deployment of VM host machine (%s)", machine.Hostname))
+	if err != nil {
+		return nil, err
+	}
+	defer releaseSlot()
 	machine, err = client.Machine.Deploy(machine.SystemID, &deployParams)
 	if err != nil {
 		return nil, err
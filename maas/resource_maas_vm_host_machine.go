@@ -2,14 +2,19 @@ package maas
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/canonical/gomaasclient/client"
 	"github.com/canonical/gomaasclient/entity"
+	"github.com/google/go-querystring/query"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
 )
 
 func resourceMaasVMHostMachine() *schema.Resource {
@@ -19,6 +24,15 @@ func resourceMaasVMHostMachine() *schema.Resource {
 		ReadContext:   resourceVMHostMachineRead,
 		UpdateContext: resourceVMHostMachineUpdate,
 		DeleteContext: resourceVMHostMachineDelete,
+		CustomizeDiff: resourceVMHostMachineCustomizeDiff,
+		SchemaVersion: 1,
+		StateUpgraders: []schema.StateUpgrader{
+			{
+				Type:    resourceMaasVMHostMachineResourceV0().CoreConfigSchema().ImpliedType(),
+				Upgrade: resourceMaasVMHostMachineStateUpgradeV0,
+				Version: 0,
+			},
+		},
 		Importer: &schema.ResourceImporter{
 			StateContext: func(ctx context.Context, d *schema.ResourceData, meta interface{}) ([]*schema.ResourceData, error) {
 				client := meta.(*client.Client)
@@ -44,6 +58,12 @@ func resourceMaasVMHostMachine() *schema.Resource {
 		UseJSONNumber: true,
 
 		Schema: map[string]*schema.Schema{
+			"architecture": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "The VM host machine architecture (e.g. `amd64/generic`). Defaults to the VM host architecture.",
+			},
 			"cores": {
 				Type:        schema.TypeInt,
 				Optional:    true,
@@ -56,6 +76,13 @@ func resourceMaasVMHostMachine() *schema.Resource {
 				Computed:    true,
 				Description: "The VM host machine domain. This is computed if it's not set.",
 			},
+			"hugepages_backed": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				ForceNew:    true,
+				Default:     false,
+				Description: "Whether the VM host machine memory is backed by hugepages. Defaults to `false`.",
+			},
 			"hostname": {
 				Type:        schema.TypeString,
 				Optional:    true,
@@ -85,6 +112,12 @@ func resourceMaasVMHostMachine() *schema.Resource {
 							Optional:    true,
 							Description: "Static IP configured on the new network interface.",
 						},
+						"macvlan_mode": {
+							Type:             schema.TypeString,
+							Optional:         true,
+							ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice([]string{"bridge", "passthru", "private", "vepa"}, false)),
+							Description:      "The macvlan mode of the network interface. Supported values are: `bridge`, `passthru`, `private`, `vepa`. It can only be set with the `macvlan` type, and defaults to the VM host `default_macvlan_mode`.",
+						},
 						"name": {
 							Type:        schema.TypeString,
 							Required:    true,
@@ -95,6 +128,12 @@ func resourceMaasVMHostMachine() *schema.Resource {
 							Optional:    true,
 							Description: "The subnet CIDR for the network interface.",
 						},
+						"type": {
+							Type:             schema.TypeString,
+							Optional:         true,
+							ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice([]string{"bridge", "macvlan"}, false)),
+							Description:      "How the network interface is attached to the VM host. Supported values are: `bridge`, `macvlan`.",
+						},
 						"vlan": {
 							Type:        schema.TypeString,
 							Optional:    true,
@@ -104,10 +143,14 @@ func resourceMaasVMHostMachine() *schema.Resource {
 				},
 			},
 			"pinned_cores": {
-				Type:        schema.TypeInt,
+				Type:        schema.TypeList,
 				Optional:    true,
 				ForceNew:    true,
-				Description: "List of host CPU cores to pin the VM host machine to. If this is passed, the `cores` parameter is ignored.",
+				Description: "List of host CPU core indices to pin the VM host machine to. If this is passed, the `cores` parameter is ignored.",
+				Elem: &schema.Schema{
+					Type:             schema.TypeInt,
+					ValidateDiagFunc: validation.ToDiagFunc(validation.IntAtLeast(0)),
+				},
 			},
 			"pool": {
 				Type:        schema.TypeString,
@@ -122,6 +165,12 @@ func resourceMaasVMHostMachine() *schema.Resource {
 				Description: "A list of storage disks for the new VM host. Parameters defined below. This argument is processed in [attribute-as-blocks mode](https://www.terraform.io/docs/configuration/attr-as-blocks.html).",
 				Elem: &schema.Resource{
 					Schema: map[string]*schema.Schema{
+						"boot": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Default:     false,
+							Description: "Whether this is the boot disk. Only one storage disk can be the boot disk, and it defaults to the first one.",
+						},
 						"pool": {
 							Type:        schema.TypeString,
 							Optional:    true,
@@ -132,6 +181,14 @@ func resourceMaasVMHostMachine() *schema.Resource {
 							Required:    true,
 							Description: "The storage disk size, specified in GB.",
 						},
+						"tags": {
+							Type:        schema.TypeSet,
+							Optional:    true,
+							Description: "A set of tag names to assign to the storage disk.",
+							Elem: &schema.Schema{
+								Type: schema.TypeString,
+							},
+						},
 					},
 				},
 			},
@@ -168,7 +225,7 @@ func resourceVMHostMachineCreate(ctx context.Context, d *schema.ResourceData, me
 	if err != nil {
 		return diag.FromErr(err)
 	}
-	machine, err := client.VMHost.Compose(vmHost.ID, params)
+	machine, err := composeVMHostMachine(client, vmHost.ID, params)
 	if err != nil {
 		return diag.FromErr(err)
 	}
@@ -232,18 +289,104 @@ func resourceVMHostMachineDelete(ctx context.Context, d *schema.ResourceData, me
 	return nil
 }
 
-func getVMHostMachineParams(d *schema.ResourceData) (*entity.VMHostMachineParams, error) {
+func resourceVMHostMachineCustomizeDiff(ctx context.Context, d *schema.ResourceDiff, meta interface{}) error {
+	// The network interfaces and storage disks are checked once they're known,
+	// e.g. a VLAN can refer to a VLAN created by the same apply
+	config := d.GetRawConfig()
+	for _, k := range []string{"network_interfaces", "storage_disks"} {
+		isKnown := d.NewValueKnown(k)
+		if !config.IsNull() {
+			isKnown = config.GetAttr(k).IsWhollyKnown()
+		}
+		if !isKnown {
+			continue
+		}
+		var err error
+		if k == "network_interfaces" {
+			_, err = getVMHostMachineNetworkInterfaces(d.Get(k).([]interface{}))
+		} else {
+			_, err = getVMHostMachineStorageDisks(d.Get(k).([]interface{}))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// vmHostMachineParams sends the pinned cores as a list, as expected by MAAS.
+type vmHostMachineParams struct {
+	entity.VMHostMachineParams
+	PinnedCores []int `url:"pinned_cores,omitempty"`
+}
+
+// vmHostComposeMutexes serializes the VM host compositions of each configured
+// MAAS client, like gomaasclient does for the compositions requested with it.
+var vmHostComposeMutexes = struct {
+	sync.Mutex
+	mutexes map[*client.Client]*sync.Mutex
+}{mutexes: map[*client.Client]*sync.Mutex{}}
+
+func getVMHostComposeMutex(client *client.Client) *sync.Mutex {
+	vmHostComposeMutexes.Lock()
+	defer vmHostComposeMutexes.Unlock()
+
+	mutex, ok := vmHostComposeMutexes.mutexes[client]
+	if !ok {
+		mutex = &sync.Mutex{}
+		vmHostComposeMutexes.mutexes[client] = mutex
+	}
+	return mutex
+}
+
+// composeVMHostMachine composes a machine with the MAAS API client directly,
+// since gomaasclient only supports a single pinned core.
+func composeVMHostMachine(client *client.Client, vmHostID int, params *vmHostMachineParams) (*entity.Machine, error) {
+	mutex := getVMHostComposeMutex(client)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	apiClient, err := getAPIClient(client)
+	if err != nil {
+		return nil, err
+	}
+	qsp, err := query.Values(params)
+	if err != nil {
+		return nil, err
+	}
+
+	machine := new(entity.Machine)
+	err = apiClient.GetSubObject("pods").GetSubObject(fmt.Sprintf("%v", vmHostID)).Post("compose", qsp, func(data []byte) error {
+		return json.Unmarshal(data, machine)
+	})
+	return machine, err
+}
+
+func getVMHostMachineParams(d *schema.ResourceData) (*vmHostMachineParams, error) {
 	networkInterfaces, err := getVMHostMachineNetworkInterfaces(d.Get("network_interfaces").([]interface{}))
 	if err != nil {
 		return nil, err
 	}
-	params := entity.VMHostMachineParams{
-		Hostname:    d.Get("hostname").(string),
-		Cores:       d.Get("cores").(int),
-		PinnedCores: d.Get("pinned_cores").(int),
-		Memory:      int64(d.Get("memory").(int)),
-		Interfaces:  networkInterfaces,
-		Storage:     getVMHostMachineStorageDisks(d.Get("storage_disks").([]interface{})),
+	storageDisks, err := getVMHostMachineStorageDisks(d.Get("storage_disks").([]interface{}))
+	if err != nil {
+		return nil, err
+	}
+	pinnedCores := []int{}
+	for _, core := range d.Get("pinned_cores").([]interface{}) {
+		pinnedCores = append(pinnedCores, core.(int))
+	}
+	params := vmHostMachineParams{
+		VMHostMachineParams: entity.VMHostMachineParams{
+			Hostname:        d.Get("hostname").(string),
+			Architecture:    d.Get("architecture").(string),
+			Cores:           d.Get("cores").(int),
+			Memory:          int64(d.Get("memory").(int)),
+			HugepagesBacked: d.Get("hugepages_backed").(bool),
+			Interfaces:      networkInterfaces,
+			Storage:         storageDisks,
+		},
+		PinnedCores: pinnedCores,
 	}
 	return &params, nil
 }
@@ -280,20 +423,56 @@ func getVMHostMachineNetworkInterfaces(networkInterfaces []interface{}) (string,
 		if ip != "" {
 			properties = append(properties, fmt.Sprintf("ip=%s", ip))
 		}
+		interfaceType := n["type"].(string)
+		if interfaceType != "" {
+			properties = append(properties, fmt.Sprintf("type=%s", interfaceType))
+		}
+		if macvlanMode := n["macvlan_mode"].(string); macvlanMode != "" {
+			if interfaceType != "macvlan" {
+				return "", fmt.Errorf("network interface (%s): macvlan_mode can only be set with the macvlan type", n["name"].(string))
+			}
+			properties = append(properties, fmt.Sprintf("macvlan_mode=%s", macvlanMode))
+		}
 		vmHostNetworkInterfaces = append(vmHostNetworkInterfaces, fmt.Sprintf("%s:%s", n["name"].(string), strings.Join(properties, ",")))
 	}
 	return strings.Join(vmHostNetworkInterfaces, ";"), nil
 }
 
-func getVMHostMachineStorageDisks(storageDisks []interface{}) string {
-	vmHostStorageDisks := []string{}
-	for i, storageDisk := range storageDisks {
+// getVMHostMachineStorageDisks returns the storage constraints of the VM host
+// machine. MAAS boots from the first disk, so the boot disk is moved first.
+func getVMHostMachineStorageDisks(storageDisks []interface{}) (string, error) {
+	disks := []map[string]interface{}{}
+	bootDisks := 0
+	for _, storageDisk := range storageDisks {
 		d := storageDisk.(map[string]interface{})
+		if d["boot"].(bool) {
+			disks = append([]map[string]interface{}{d}, disks...)
+			bootDisks++
+		} else {
+			disks = append(disks, d)
+		}
+	}
+	if bootDisks > 1 {
+		return "", fmt.Errorf("storage_disks: only one storage disk can be the boot disk")
+	}
+
+	vmHostStorageDisks := []string{}
+	for i, d := range disks {
 		disk := fmt.Sprintf("disk%d:%d", i, int64(d["size_gigabytes"].(int)))
+		// The pool is given as the first disk tag
+		tags := []string{}
 		if pool := d["pool"].(string); pool != "" {
-			disk = fmt.Sprintf("%s(%s)", disk, pool)
+			tags = append(tags, pool)
+		}
+		if t, ok := d["tags"].(*schema.Set); ok {
+			diskTags := convertToStringSlice(t.List())
+			sort.Strings(diskTags)
+			tags = append(tags, diskTags...)
+		}
+		if len(tags) > 0 {
+			disk = fmt.Sprintf("%s(%s)", disk, strings.Join(tags, ","))
 		}
 		vmHostStorageDisks = append(vmHostStorageDisks, disk)
 	}
-	return strings.Join(vmHostStorageDisks, ",")
+	return strings.Join(vmHostStorageDisks, ","), nil
 }
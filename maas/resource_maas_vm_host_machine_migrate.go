@@ -0,0 +1,146 @@
+package maas
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+func resourceMaasVMHostMachineResourceV0() *schema.Resource {
+	return &schema.Resource{
+		Schema: map[string]*schema.Schema{
+			"cores": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "The number of CPU cores (defaults to 1).",
+			},
+			"domain": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "The VM host machine domain. This is computed if it's not set.",
+			},
+			"hostname": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "The VM host machine hostname. This is computed if it's not set.",
+			},
+			"memory": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "The VM host machine RAM memory, specified in MB (defaults to 2048).",
+			},
+			"network_interfaces": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "A list of network interfaces for new the VM host. This argument only works when the VM host is deployed from a registered MAAS machine. Parameters defined below. This argument is processed in [attribute-as-blocks mode](https://www.terraform.io/docs/configuration/attr-as-blocks.html).",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"fabric": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "The fabric for the network interface.",
+						},
+						"ip_address": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Static IP configured on the new network interface.",
+						},
+						"name": {
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "The network interface name.",
+						},
+						"subnet_cidr": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "The subnet CIDR for the network interface.",
+						},
+						"vlan": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "The VLAN for the network interface.",
+						},
+					},
+				},
+			},
+			"pinned_cores": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "List of host CPU cores to pin the VM host machine to. If this is passed, the `cores` parameter is ignored.",
+			},
+			"pool": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "The VM host machine pool. This is computed if it's not set.",
+			},
+			"storage_disks": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "A list of storage disks for the new VM host. Parameters defined below. This argument is processed in [attribute-as-blocks mode](https://www.terraform.io/docs/configuration/attr-as-blocks.html).",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"pool": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "The VM host storage pool name.",
+						},
+						"size_gigabytes": {
+							Type:        schema.TypeInt,
+							Required:    true,
+							Description: "The storage disk size, specified in GB.",
+						},
+					},
+				},
+			},
+			"vm_host": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "ID or name of the VM host used to compose the new machine.",
+			},
+			"zone": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "The VM host machine zone. This is computed if it's not set.",
+			},
+		},
+	}
+}
+
+func resourceMaasVMHostMachineStateUpgradeV0(ctx context.Context, rawState map[string]interface{}, meta interface{}) (map[string]interface{}, error) {
+	// Convert pinned_cores from a single core to a list of cores. The core
+	// wasn't sent to MAAS when it was 0.
+	pinnedCores := []interface{}{}
+	switch v := rawState["pinned_cores"].(type) {
+	case nil:
+	case json.Number:
+		core, err := v.Int64()
+		if err != nil {
+			return nil, err
+		}
+		if core != 0 {
+			pinnedCores = append(pinnedCores, core)
+		}
+	case float64:
+		if v != 0 {
+			pinnedCores = append(pinnedCores, int64(v))
+		}
+	default:
+		return nil, fmt.Errorf("unexpected pinned_cores value: %v", v)
+	}
+
+	rawState["pinned_cores"] = pinnedCores
+
+	return rawState, nil
+}
@@ -0,0 +1,25 @@
+package maas
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResourceMaasVMHostMachineStateUpgradeV0(t *testing.T) {
+	for _, testCase := range []struct {
+		pinnedCores interface{}
+		expected    []interface{}
+	}{
+		{pinnedCores: json.Number("3"), expected: []interface{}{int64(3)}},
+		{pinnedCores: float64(3), expected: []interface{}{int64(3)}},
+		{pinnedCores: float64(0), expected: []interface{}{}},
+		{pinnedCores: nil, expected: []interface{}{}},
+	} {
+		state, err := resourceMaasVMHostMachineStateUpgradeV0(context.Background(), map[string]interface{}{"pinned_cores": testCase.pinnedCores}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, testCase.expected, state["pinned_cores"])
+	}
+}
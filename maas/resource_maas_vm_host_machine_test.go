@@ -0,0 +1,193 @@
+package maas
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/canonical/gomaasclient/client"
+	"github.com/canonical/gomaasclient/entity"
+	"github.com/google/go-querystring/query"
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetVMHostMachineParams(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceMaasVMHostMachine().Schema, map[string]interface{}{
+		"vm_host":          "1",
+		"architecture":     "amd64/generic",
+		"memory":           8192,
+		"pinned_cores":     []interface{}{2, 3},
+		"hugepages_backed": true,
+		"storage_disks": []interface{}{
+			map[string]interface{}{"size_gigabytes": 100, "pool": "fast", "tags": []interface{}{"ssd", "data"}},
+			map[string]interface{}{"size_gigabytes": 20, "boot": true},
+		},
+		"network_interfaces": []interface{}{
+			map[string]interface{}{"name": "eth0", "subnet_cidr": "10.0.0.0/24", "type": "bridge"},
+			map[string]interface{}{"name": "eth1", "vlan": "100", "type": "macvlan", "macvlan_mode": "vepa"},
+		},
+	})
+
+	params, err := getVMHostMachineParams(d)
+	assert.NoError(t, err)
+	qsp, err := query.Values(params)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2", "3"}, qsp["pinned_cores"])
+	assert.Equal(t, []string{"true"}, qsp["hugepages_backed"])
+	assert.Equal(t, []string{"amd64/generic"}, qsp["architecture"])
+	assert.Equal(t, []string{"disk0:20,disk1:100(fast,data,ssd)"}, qsp["storage"])
+	assert.Equal(t, []string{"eth0:subnet_cidr=10.0.0.0/24,type=bridge;eth1:vlan=100,type=macvlan,macvlan_mode=vepa"}, qsp["interfaces"])
+	assert.NotContains(t, qsp, "cores")
+}
+
+func TestComposeVMHostMachine(t *testing.T) {
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/api/2.0/pods/1/", r.URL.Path)
+		assert.Equal(t, "compose", r.URL.Query().Get("op"))
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			assert.NoError(t, r.ParseForm())
+		}
+		form = r.PostForm
+		fmt.Fprint(w, `{"system_id": "abc123"}`)
+	}))
+	defer server.Close()
+
+	c, err := client.GetClient(server.URL, "consumer:token:secret", "2.0")
+	assert.NoError(t, err)
+	networkInterfaces, err := getVMHostMachineNetworkInterfaces([]interface{}{
+		map[string]interface{}{"name": "eth0", "fabric": "", "vlan": "", "subnet_cidr": "10.0.0.0/24", "ip_address": "", "type": "bridge", "macvlan_mode": ""},
+		map[string]interface{}{"name": "eth1", "fabric": "", "vlan": "100", "subnet_cidr": "", "ip_address": "", "type": "macvlan", "macvlan_mode": "vepa"},
+	})
+	assert.NoError(t, err)
+
+	machine, err := composeVMHostMachine(c, 1, &vmHostMachineParams{
+		VMHostMachineParams: entity.VMHostMachineParams{Interfaces: networkInterfaces},
+		PinnedCores:         []int{2, 3},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "abc123", machine.SystemID)
+	assert.Equal(t, []string{"eth0:subnet_cidr=10.0.0.0/24,type=bridge;eth1:vlan=100,type=macvlan,macvlan_mode=vepa"}, form["interfaces"])
+	assert.Equal(t, []string{"2", "3"}, form["pinned_cores"])
+}
+
+func TestGetVMHostComposeMutex(t *testing.T) {
+	c1, err := client.GetClient("http://maas-01:5240/MAAS", "consumer:token:secret", "2.0")
+	assert.NoError(t, err)
+	c2, err := client.GetClient("http://maas-02:5240/MAAS", "consumer:token:secret", "2.0")
+	assert.NoError(t, err)
+
+	assert.Same(t, getVMHostComposeMutex(c1), getVMHostComposeMutex(c1))
+	assert.NotSame(t, getVMHostComposeMutex(c1), getVMHostComposeMutex(c2))
+}
+
+func TestResourceVMHostMachineDiff(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config map[string]interface{}
+		err    string
+	}{
+		{
+			name: "macvlan",
+			config: map[string]interface{}{"vm_host": "1", "network_interfaces": []interface{}{
+				map[string]interface{}{"name": "eth0", "vlan": "100", "type": "macvlan", "macvlan_mode": "vepa"},
+			}},
+		},
+		{
+			name: "macvlan mode without macvlan type",
+			config: map[string]interface{}{"vm_host": "1", "network_interfaces": []interface{}{
+				map[string]interface{}{"name": "eth0", "vlan": "100", "type": "bridge", "macvlan_mode": "vepa"},
+			}},
+			err: "network interface (eth0): macvlan_mode can only be set with the macvlan type",
+		},
+		{
+			name: "two boot disks",
+			config: map[string]interface{}{"vm_host": "1", "storage_disks": []interface{}{
+				map[string]interface{}{"size_gigabytes": 20, "boot": true},
+				map[string]interface{}{"size_gigabytes": 20, "boot": true},
+			}},
+			err: "storage_disks: only one storage disk can be the boot disk",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, err := resourceMaasVMHostMachine().Diff(context.Background(), nil, terraform.NewResourceConfigRaw(testCase.config), nil)
+			if testCase.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, testCase.err)
+			}
+		})
+	}
+}
+
+func TestResourceVMHostMachineNetworkInterfacesDiff(t *testing.T) {
+	testCases := []struct {
+		name          string
+		interfaceType cty.Value
+		err           string
+	}{
+		{name: "unknown type", interfaceType: cty.UnknownVal(cty.String)},
+		{name: "bridge type", interfaceType: cty.StringVal("bridge"), err: "network interface (eth0): macvlan_mode can only be set with the macvlan type"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			// The unknown values are read as zero values during the plan, only
+			// the raw configuration tells them apart
+			configType := resourceMaasVMHostMachine().CoreConfigSchema().ImpliedType()
+			networkInterfaceType := configType.AttributeType("network_interfaces").ElementType()
+			networkInterface := map[string]cty.Value{}
+			for k, attrType := range networkInterfaceType.AttributeTypes() {
+				networkInterface[k] = cty.NullVal(attrType)
+			}
+			networkInterface["name"] = cty.StringVal("eth0")
+			networkInterface["vlan"] = cty.StringVal("100")
+			networkInterface["macvlan_mode"] = cty.StringVal("vepa")
+			networkInterface["type"] = testCase.interfaceType
+			rawConfig := map[string]cty.Value{}
+			for k, attrType := range configType.AttributeTypes() {
+				rawConfig[k] = cty.NullVal(attrType)
+			}
+			rawConfig["vm_host"] = cty.StringVal("1")
+			rawConfig["network_interfaces"] = cty.ListVal([]cty.Value{cty.ObjectVal(networkInterface)})
+
+			networkInterfaceConfig := map[string]interface{}{"name": "eth0", "vlan": "100", "macvlan_mode": "vepa"}
+			if testCase.interfaceType.IsKnown() {
+				networkInterfaceConfig["type"] = testCase.interfaceType.AsString()
+			}
+			state := &terraform.InstanceState{RawConfig: cty.ObjectVal(rawConfig)}
+			config := terraform.NewResourceConfigRaw(map[string]interface{}{
+				"vm_host":            "1",
+				"network_interfaces": []interface{}{networkInterfaceConfig},
+			})
+			_, err := resourceMaasVMHostMachine().Diff(context.Background(), state, config, nil)
+			if testCase.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, testCase.err)
+			}
+		})
+	}
+}
+
+func TestGetVMHostMachineParamsErrors(t *testing.T) {
+	_, err := getVMHostMachineStorageDisks([]interface{}{
+		map[string]interface{}{"size_gigabytes": 20, "pool": "", "boot": true},
+		map[string]interface{}{"size_gigabytes": 20, "pool": "", "boot": true},
+	})
+	assert.EqualError(t, err, "storage_disks: only one storage disk can be the boot disk")
+
+	_, err = getVMHostMachineNetworkInterfaces([]interface{}{
+		map[string]interface{}{"name": "eth0", "fabric": "", "vlan": "", "subnet_cidr": "10.0.0.0/24", "ip_address": "", "type": "bridge", "macvlan_mode": "vepa"},
+	})
+	assert.EqualError(t, err, "network interface (eth0): macvlan_mode can only be set with the macvlan type")
+}
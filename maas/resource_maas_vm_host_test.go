@@ -0,0 +1,125 @@
+package maas
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+
+	"github.com/canonical/gomaasclient/entity"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateVMHostCertificate(t *testing.T) {
+	certificate, key, err := generateVMHostCertificate("lxd-01")
+	assert.NoError(t, err)
+
+	keyPair, err := tls.X509KeyPair([]byte(certificate), []byte(key))
+	assert.NoError(t, err)
+	parsed, err := x509.ParseCertificate(keyPair.Certificate[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "terraform-provider-maas@lxd-01", parsed.Subject.CommonName)
+	assert.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, parsed.ExtKeyUsage)
+}
+
+func TestResourceVMHostLXDOptionsDiff(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config map[string]interface{}
+		err    string
+	}{
+		{
+			name:   "lxd",
+			config: map[string]interface{}{"type": "lxd", "power_address": "10.0.0.1", "password": "secret", "project": "maas"},
+		},
+		{
+			name:   "virsh",
+			config: map[string]interface{}{"type": "virsh", "power_address": "qemu+ssh://10.0.0.1/system", "project": "maas"},
+			err:    "project: can only be set on the lxd VM hosts",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, err := resourceMaasVMHost().Diff(context.Background(), nil, terraform.NewResourceConfigRaw(testCase.config), nil)
+			if testCase.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, testCase.err)
+			}
+		})
+	}
+}
+
+func TestGetVMHostStoragePools(t *testing.T) {
+	vmHost := &entity.VMHost{
+		StoragePools: []entity.VMHostStoragePool{
+			{ID: "1", Name: "default", Type: "dir", Path: "/var/lib/lxd/storage-pools/default", Total: 100, Used: 40, Available: 60},
+			{ID: "2", Name: "fast", Type: "zfs", Path: "tank/lxd", Total: 500, Used: 100, Available: 400, Default: true},
+		},
+	}
+
+	assert.Equal(t, "fast", getVMHostDefaultStoragePool(vmHost))
+	assert.Equal(t, "", getVMHostDefaultStoragePool(&entity.VMHost{}))
+
+	id, err := getVMHostStoragePoolID(vmHost, "fast")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", id)
+	_, err = getVMHostStoragePoolID(&entity.VMHost{Name: "lxd-01"}, "fast")
+	assert.EqualError(t, err, "VM host (lxd-01) has no storage pool named (fast)")
+	assert.Equal(t, []map[string]interface{}{
+		{"name": "default", "type": "dir", "path": "/var/lib/lxd/storage-pools/default", "default": false, "total": int64(100), "used": int64(40), "available": int64(60)},
+		{"name": "fast", "type": "zfs", "path": "tank/lxd", "default": true, "total": int64(500), "used": int64(100), "available": int64(400)},
+	}, getVMHostStoragePoolsState(vmHost.StoragePools))
+}
+
+func TestResourceVMHostRefreshTriggersDiff(t *testing.T) {
+	state := &terraform.InstanceState{
+		ID: "1",
+		Attributes: map[string]string{
+			"id":                        "1",
+			"type":                      "virsh",
+			"power_address":             "qemu+ssh://10.0.0.1/system",
+			"refresh_triggers.%":        "1",
+			"refresh_triggers.disks":    "1",
+			"resources_cores_total":     "16",
+			"resources_cores_available": "12",
+		},
+	}
+	config := terraform.NewResourceConfigRaw(map[string]interface{}{
+		"type":             "virsh",
+		"power_address":    "qemu+ssh://10.0.0.1/system",
+		"refresh_triggers": map[string]interface{}{"disks": "2"},
+	})
+
+	diff, err := resourceMaasVMHost().Diff(context.Background(), state, config, nil)
+	assert.NoError(t, err)
+	assert.False(t, diff.RequiresNew())
+	assert.True(t, diff.Attributes["resources_cores_total"].NewComputed)
+	assert.True(t, diff.Attributes["resources_cores_available"].NewComputed)
+	assert.Equal(t, "2", diff.Attributes["refresh_triggers.disks"].New)
+}
+
+func TestResourceVMHostPasswordDiff(t *testing.T) {
+	state := &terraform.InstanceState{
+		ID: "1",
+		Attributes: map[string]string{
+			"id":            "1",
+			"type":          "lxd",
+			"power_address": "10.0.0.1",
+			"password":      "secret",
+		},
+	}
+	config := terraform.NewResourceConfigRaw(map[string]interface{}{
+		"type":          "lxd",
+		"power_address": "10.0.0.1",
+		"password":      "changed",
+	})
+
+	diff, err := resourceMaasVMHost().Diff(context.Background(), state, config, nil)
+	assert.NoError(t, err)
+	if diff != nil {
+		assert.NotContains(t, diff.Attributes, "password")
+	}
+}
@@ -1,9 +1,9 @@
 package maas
 
 import (
-	"encoding/base64"
 	"fmt"
 	"net/mail"
+	"text/template"
 
 	"github.com/canonical/gomaasclient/client"
 	"github.com/canonical/gomaasclient/entity"
@@ -14,19 +14,6 @@ import (
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
 )
 
-func base64Encode(data []byte) string {
-	if isBase64Encoded(data) {
-		return string(data)
-	}
-
-	return base64.StdEncoding.EncodeToString(data)
-}
-
-func isBase64Encoded(data []byte) bool {
-	_, err := base64.StdEncoding.DecodeString(string(data))
-	return err == nil
-}
-
 func convertToStringSlice(field interface{}) []string {
 	if field == nil {
 		return nil
@@ -90,6 +77,41 @@ func isEmailAddress(i interface{}, p cty.Path) diag.Diagnostics {
 	return diags
 }
 
+func isTemplate(i interface{}, p cty.Path) diag.Diagnostics {
+	var diags diag.Diagnostics
+	attr := p[len(p)-1].(cty.GetAttrStep)
+
+	v, ok := i.(string)
+	if !ok {
+		return append(diags, diag.Diagnostic{
+			Severity:      diag.Error,
+			Summary:       fmt.Sprintf("expected type of %q to be string", attr.Name),
+			AttributePath: p,
+		})
+	}
+
+	if _, err := template.New(attr.Name).Parse(v); err != nil {
+		diags = append(diags, diag.Diagnostic{
+			Severity:      diag.Error,
+			Summary:       fmt.Sprintf("expected %s to be a valid template, got: %s", attr.Name, err),
+			AttributePath: p,
+		})
+	}
+
+	return diags
+}
+
+// getAPIClient returns the low-level MAAS API client shared by all the
+// gomaasclient endpoints. It is used to call the MAAS API operations that are
+// not yet covered by gomaasclient.
+func getAPIClient(c *client.Client) (*client.APIClient, error) {
+	maasServer, ok := c.MAASServer.(*client.MAASServer)
+	if !ok {
+		return nil, fmt.Errorf("unable to get the MAAS API client")
+	}
+	return &maasServer.APIClient, nil
+}
+
 func getNetworkInterface(client *client.Client, machineSystemID string, identifier string) (*entity.NetworkInterface, error) {
 	networkInterfaces, err := client.NetworkInterfaces.Get(machineSystemID)
 	if err != nil {
@@ -8,34 +8,6 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func TestBase64Encode(t *testing.T) {
-	testCases := []struct {
-		name string
-		in   []byte
-		out  string
-	}{
-		// normal encoding case
-		{
-			name: "data is encoded",
-			in:   []byte("data should be encoded"),
-			out:  "ZGF0YSBzaG91bGQgYmUgZW5jb2RlZA==",
-		},
-		// base64 encoded input should result in no change of output
-		{
-			name: "data already encoded",
-			in:   []byte("ZGF0YSBzaG91bGQgYmUgZW5jb2RlZA=="),
-			out:  "ZGF0YSBzaG91bGQgYmUgZW5jb2RlZA==",
-		},
-	}
-
-	for _, testCase := range testCases {
-		t.Run(testCase.name, func(t *testing.T) {
-			out := base64Encode(testCase.in)
-			assert.Equal(t, testCase.out, out, fmt.Sprintf("base64Encode(%s) => %s, want %s", testCase.in, out, testCase.out))
-		})
-	}
-}
-
 func TestConvertToStringSlice(t *testing.T) {
 	testCases := []struct {
 		name string
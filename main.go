@@ -4,12 +4,22 @@ import (
 	"context"
 	"flag"
 	"log"
+	"os"
+	"strings"
 	"terraform-provider-maas/maas"
 
 	"github.com/hashicorp/terraform-plugin-sdk/v2/plugin"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := export(os.Args[2:]); err != nil {
+			log.Fatal(err.Error())
+		}
+
+		return
+	}
+
 	var debugMode bool
 
 	flag.BoolVar(&debugMode, "debug", false, "set to true to run the provider with support for debuggers like delve")
@@ -29,3 +39,29 @@ func main() {
 
 	plugin.Serve(opts)
 }
+
+// export generates the Terraform configuration, and the import blocks, of
+// the objects of an existing MAAS.
+func export(args []string) error {
+	var config maas.Config
+	var resourceTypes, outputDir string
+
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.StringVar(&config.APIKey, "api-key", os.Getenv("MAAS_API_KEY"), "the MAAS API key (defaults to $MAAS_API_KEY)")
+	flags.StringVar(&config.APIURL, "api-url", os.Getenv("MAAS_API_URL"), "the MAAS API URL (defaults to $MAAS_API_URL)")
+	flags.StringVar(&config.ApiVersion, "api-version", "2.0", "the MAAS API version")
+	flags.StringVar(&config.TLSCACertPath, "tls-ca-cert-path", os.Getenv("MAAS_API_CACERT"), "certificate CA bundle path to use to verify the MAAS certificate (defaults to $MAAS_API_CACERT)")
+	flags.BoolVar(&config.TLSInsecureSkipVerify, "tls-insecure-skip-verify", false, "skip TLS certificate verification")
+	flags.StringVar(&resourceTypes, "resources", strings.Join(maas.ExportResourceTypes, ","), "comma separated list of the resource types to export")
+	flags.StringVar(&outputDir, "output-dir", ".", "the directory where the Terraform files are written")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	client, err := config.Client()
+	if err != nil {
+		return err
+	}
+
+	return maas.Export(client, strings.Split(resourceTypes, ","), outputDir)
+}